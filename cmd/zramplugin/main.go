@@ -20,8 +20,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/boris257/csi-driver-zram/pkg/zram"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog/v2"
 )
 
@@ -37,6 +39,27 @@ var (
 	enableGetVolumeStats = flag.Bool("enable-get-volume-stats", true, "allow GET_VOLUME_STATS on agent node")
 	enableTopology       = flag.Bool("enable-topology", true, "allow GET_VOLUME_STATS on agent node")
 	workingMountDir      = flag.String("working-mount-dir", "/tmp", "working directory for provisioner to mount zram shares temporarily")
+	metricsAddress       = flag.String("metrics-address", "", "address to serve Prometheus metrics on, e.g. :29754, disabled if empty")
+	compactInterval      = flag.Duration("compact-interval", 0, "how often staged zram devices are checked for memory compaction, disabled if 0")
+	compactThreshold     = flag.Float64("compact-fragmentation-threshold", 0, "compact a device when mem_used_total / compr_data_size reaches this ratio, always compact if 0")
+	readOnlyInterval     = flag.Duration("readonly-watchdog-interval", 10*time.Second, "how often the memory usage of staged filesystems is checked against their memory limit, disabled if 0")
+	readOnlyWatermark    = flag.Float64("readonly-watermark", 95, "percentage of the memory limit above which a staged filesystem is remounted read-only")
+	readOnlyRecover      = flag.Float64("readonly-recover-watermark", 85, "percentage of the memory limit below which a filesystem remounted read-only is remounted read-write, never if 0")
+	compressionRatio     = flag.Float64("capacity-compression-ratio", 2, "compression ratio expected when reporting the capacity of the node")
+	overcommit           = flag.Float64("capacity-overcommit", 1, "factor by which the reported capacity may exceed the free memory of the node")
+	maxTotalZRAMBytes    = flag.String("max-total-zram-bytes", "", "maximum combined size of the zram volumes staged on the node, e.g. 64Gi, unlimited if empty")
+	maxTotalZRAMPercent  = flag.Float64("max-total-zram-percent", 0, "maximum combined size of the zram volumes staged on the node as a percentage of its memory, unlimited if 0")
+	kubeletDir           = flag.String("kubelet-dir", "/var/lib/kubelet", "kubelet root directory")
+	stateDir             = flag.String("state-dir", "/var/run/zram.csi.k8s.io", "directory recording the volumes staged on the node, cleared on reboot")
+	gcInterval           = flag.Duration("gc-interval", 0, "how often zram devices left behind by the driver are looked for and removed, disabled if 0")
+	gcGracePeriod        = flag.Duration("gc-grace-period", 5*time.Minute, "how long a zram device must stay orphaned before it is removed")
+	gcDryRun             = flag.Bool("gc-dry-run", false, "only log the orphaned zram devices that would be removed")
+	reconcileInterval    = flag.Duration("reconcile-interval", time.Minute, "how often the mounts and zram devices of the staged volumes are checked and lost publish mounts restored, disabled if 0")
+	generationDir        = flag.String("generation-dir", "/var/lib/zram.csi.k8s.io/generations", "directory recording the volumes staged on the node across reboots, to detect the loss of their data")
+	recordDir            = flag.String("record-dir", "/var/lib/zram.csi.k8s.io/volumes", "directory recording what the node learned about its volumes until they are deleted, such as their expanded capacity")
+	snapshotDir          = flag.String("snapshot-dir", "/var/lib/zram.csi.k8s.io/snapshots", "directory holding the compressed archives of the snapshots taken on the node, snapshots are disabled if empty")
+	backingDirRoot       = flag.String("backing-dir-root", "/var/lib/zram-backing", "directory the backingDir of volumes must be in, backing devices are disabled if empty")
+	dictionaryDir        = flag.String("dictionary-dir", "/var/lib/zram.csi.k8s.io/dictionaries", "directory holding compression dictionaries referenced by the compDictionary parameter")
 )
 
 func main() {
@@ -53,17 +76,50 @@ func main() {
 		// nodeid is not needed in controller component
 		klog.Warning("nodeid is empty")
 	}
+	if *readOnlyWatermark <= 0 || *readOnlyWatermark > 100 || *readOnlyRecover < 0 || *readOnlyRecover >= *readOnlyWatermark {
+		klog.Fatalf("invalid read-only watermarks %v and %v, expected 0 <= readonly-recover-watermark < readonly-watermark <= 100",
+			*readOnlyRecover, *readOnlyWatermark)
+	}
 	handle()
 	os.Exit(0)
 }
 
 func handle() {
+	var maxTotalBytes int64
+	if *maxTotalZRAMBytes != "" {
+		quantity, err := resource.ParseQuantity(*maxTotalZRAMBytes)
+		if err != nil {
+			klog.Fatalf("invalid max-total-zram-bytes %q: %v", *maxTotalZRAMBytes, err)
+		}
+		maxTotalBytes = quantity.Value()
+	}
 	driverOptions := zram.DriverOptions{
-		NodeID:               *nodeID,
-		DriverName:           *driverName,
-		EnableGetVolumeStats: *enableGetVolumeStats,
-		WorkingMountDir:      *workingMountDir,
-		EnableTopology:       *enableTopology,
+		NodeID:                        *nodeID,
+		DriverName:                    *driverName,
+		EnableGetVolumeStats:          *enableGetVolumeStats,
+		WorkingMountDir:               *workingMountDir,
+		EnableTopology:                *enableTopology,
+		DictionaryDir:                 *dictionaryDir,
+		BackingDirRoot:                *backingDirRoot,
+		MetricsAddress:                *metricsAddress,
+		CompactInterval:               *compactInterval,
+		CompactFragmentationThreshold: *compactThreshold,
+		ReadOnlyWatchdogInterval:      *readOnlyInterval,
+		ReadOnlyWatermark:             *readOnlyWatermark,
+		ReadOnlyRecoverWatermark:      *readOnlyRecover,
+		CapacityCompressionRatio:      *compressionRatio,
+		CapacityOvercommit:            *overcommit,
+		MaxTotalZRAMBytes:             maxTotalBytes,
+		MaxTotalZRAMPercent:           *maxTotalZRAMPercent,
+		KubeletDir:                    *kubeletDir,
+		StateDir:                      *stateDir,
+		GenerationDir:                 *generationDir,
+		RecordDir:                     *recordDir,
+		SnapshotDir:                   *snapshotDir,
+		GCInterval:                    *gcInterval,
+		GCGracePeriod:                 *gcGracePeriod,
+		GCDryRun:                      *gcDryRun,
+		ReconcileInterval:             *reconcileInterval,
 	}
 	driver := zram.NewDriver(&driverOptions)
 	driver.Run(*endpoint, false)
@@ -1,6 +1,11 @@
 package fs
 
-import "golang.org/x/sys/unix"
+import (
+	"math"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
 
 // Info linux returns (available bytes, byte capacity, byte usage, total inodes, inodes free, inode usage, error)
 // for the filesystem that path resides upon.
@@ -26,3 +31,59 @@ func Info(path string) (int64, int64, int64, int64, int64, int64, error) {
 
 	return available, capacity, usage, inodes, inodesFree, inodesUsed, nil
 }
+
+// fitrim is FITRIM, _IOWR('X', 121, struct fstrim_range)
+const fitrim = 0xc0185879
+
+// fstrimRange mirrors struct fstrim_range of linux/fs.h
+type fstrimRange struct {
+	start  uint64
+	length uint64
+	minLen uint64
+}
+
+// Trim discards the unused blocks of the filesystem mounted at path, like fstrim(8),
+// and returns the number of bytes trimmed as reported by the filesystem.
+func Trim(path string) (uint64, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	r := fstrimRange{length: math.MaxUint64}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fitrim, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return 0, errno
+	}
+	return r.length, nil
+}
+
+// fifreeze and fithaw are FIFREEZE, _IOWR('X', 119, int), and FITHAW, _IOWR('X', 120, int)
+const (
+	fifreeze = 0xc0045877
+	fithaw   = 0xc0045878
+)
+
+// Freeze suspends writes to the filesystem mounted at path and flushes it to its device,
+// like fsfreeze(8). Writers block until Thaw is called.
+func Freeze(path string) error {
+	return ioctlDir(path, fifreeze)
+}
+
+// Thaw resumes writes to a filesystem suspended by Freeze.
+func Thaw(path string) error {
+	return ioctlDir(path, fithaw)
+}
+
+func ioctlDir(path string, req uintptr) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
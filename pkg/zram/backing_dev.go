@@ -0,0 +1,230 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+)
+
+// backingFilePath returns the sparse file behind the backing device of a volume.
+func backingFilePath(dir, volumeID string) string {
+	return filepath.Join(dir, url.PathEscape(volumeID)+".img")
+}
+
+// validateBackingDir checks that a backingDir requested by a StorageClass is below the
+// directory the node plugin allows backing files in, symbolic links included.
+func (d *Driver) validateBackingDir(dir string) error {
+	if d.backingDirRoot == "" {
+		return fmt.Errorf("%s is not allowed, backing devices are disabled on node %s", backingDirField, d.NodeID)
+	}
+	if !isWithinDir(d.backingDirRoot, dir) {
+		return fmt.Errorf("%s %s is not below %s", backingDirField, dir, d.backingDirRoot)
+	}
+	root, err := filepath.EvalSymlinks(d.backingDirRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// only checked lexically where the root is not mounted, e.g. in the controller
+			return nil
+		}
+		return err
+	}
+	// the directory is created on demand, resolve its closest existing parent
+	existing := filepath.Clean(dir)
+	resolved, err := filepath.EvalSymlinks(existing)
+	for os.IsNotExist(err) && existing != filepath.Dir(existing) {
+		existing = filepath.Dir(existing)
+		resolved, err = filepath.EvalSymlinks(existing)
+	}
+	if err != nil {
+		return err
+	}
+	if !isWithinDir(root, resolved) {
+		return fmt.Errorf("%s %s resolves to %s, which is not below %s", backingDirField, dir, resolved, d.backingDirRoot)
+	}
+	return nil
+}
+
+// isWithinDir returns true if path is dir or below it.
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// createBackingDev creates a sparse file of the given size and attaches a loop device to it.
+// It returns the path of the loop device. An existing file is never reused, so that nothing
+// outside of the driver is truncated.
+func createBackingDev(file string, size int64) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return "", err
+	}
+	fd, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("backing file %s already exists", file)
+		}
+		return "", err
+	}
+	err = fd.Truncate(size)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+		return "", fmt.Errorf("failed to allocate %s: %v", file, err)
+	}
+
+	out, err := exec.New().Command("losetup", "--find", "--show", file).CombinedOutput()
+	if err != nil {
+		os.Remove(file)
+		return "", fmt.Errorf("losetup %s failed: %v, output: %s", file, err, string(out))
+	}
+	loopDev := strings.TrimSpace(string(out))
+	klog.V(2).Infof("attached %s to backing file %s", loopDev, file)
+	return loopDev, nil
+}
+
+// deleteBackingDev detaches the loop device and removes its backing file.
+func deleteBackingDev(loopDev string) error {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/block", filepath.Base(loopDev), "loop/backing_file"))
+	if err != nil {
+		return fmt.Errorf("failed to get backing file of %s: %v", loopDev, err)
+	}
+	file := strings.TrimSpace(string(data))
+
+	out, err := exec.New().Command("losetup", "--detach", loopDev).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("losetup --detach %s failed: %v, output: %s", loopDev, err, string(out))
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	klog.V(2).Infof("detached %s and removed backing file %s", loopDev, file)
+	return nil
+}
+
+// attachedBackingFiles returns the files loop devices are attached to.
+func attachedBackingFiles() (map[string]bool, error) {
+	paths, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, err
+	}
+	attached := make(map[string]bool)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			// the loop device was detached in the meantime
+			continue
+		}
+		attached[strings.TrimSuffix(strings.TrimSpace(string(data)), " (deleted)")] = true
+	}
+	return attached, nil
+}
+
+// isAttached returns true if a loop device is attached to file, which the kernel reports
+// with its symbolic links resolved.
+func isAttached(file string, attached map[string]bool) bool {
+	if resolved, err := filepath.EvalSymlinks(file); err == nil {
+		file = resolved
+	}
+	return attached[filepath.Clean(file)]
+}
+
+// removeDetachedBackingFiles removes the backing files no loop device is attached to, left
+// behind by a crash or a reboot, and returns the files still attached.
+func removeDetachedBackingFiles(files []string, attached map[string]bool) []string {
+	var kept []string
+	for _, file := range files {
+		if isAttached(file, attached) {
+			kept = append(kept, file)
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			if !os.IsNotExist(err) {
+				klog.Warningf("failed to remove stale backing file %s: %v", file, err)
+				kept = append(kept, file)
+			}
+			continue
+		}
+		klog.V(2).Infof("removed stale backing file %s", file)
+	}
+	return kept
+}
+
+// reclaimBackingFile records the backing file about to be created for a volume, so that it is
+// known as the driver's own if it is left behind. A file left behind by a previous stage of the
+// volume is removed, files the driver did not record are never touched.
+func (d *Driver) reclaimBackingFile(volumeID, file string) error {
+	record, err := d.records.Load(volumeID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		record = &volumeRecord{VolumeID: volumeID}
+	}
+	for _, recorded := range record.BackingFiles {
+		if recorded != file {
+			continue
+		}
+		attached, err := attachedBackingFiles()
+		if err != nil {
+			return err
+		}
+		removeDetachedBackingFiles([]string{file}, attached)
+		return nil
+	}
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("backing file %s already exists", file)
+	}
+	record.BackingFiles = append(record.BackingFiles, file)
+	return d.records.Save(record)
+}
+
+// removeStaleBackingFiles removes the recorded backing files of all volumes that no loop
+// device is attached to, e.g. after a reboot.
+func (d *Driver) removeStaleBackingFiles() {
+	records, err := d.records.List()
+	if err != nil {
+		klog.Warningf("failed to list volume records: %v", err)
+		return
+	}
+	attached, err := attachedBackingFiles()
+	if err != nil {
+		klog.Warningf("failed to list backing files of loop devices: %v", err)
+		return
+	}
+	for _, record := range records {
+		if len(record.BackingFiles) == 0 {
+			continue
+		}
+		kept := removeDetachedBackingFiles(record.BackingFiles, attached)
+		if len(kept) == len(record.BackingFiles) {
+			continue
+		}
+		record.BackingFiles = kept
+		if err := d.records.Save(record); err != nil {
+			klog.Warningf("failed to record backing files of volume %s: %v", record.VolumeID, err)
+		}
+	}
+}
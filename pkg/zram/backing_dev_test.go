@@ -0,0 +1,120 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackingFilePath(t *testing.T) {
+	assert.Equal(t, "/var/lib/zram/pvc-1234.img", backingFilePath("/var/lib/zram", "pvc-1234"))
+	assert.Equal(t, "/var/lib/zram/a%2Fb%23c.img", backingFilePath("/var/lib/zram", "a/b#c"))
+	assert.NotEqual(t, backingFilePath("/var/lib/zram", "a/b"), backingFilePath("/var/lib/zram", "a#b"))
+}
+
+func TestValidateBackingDir(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+
+	d := NewFakeDriver()
+	assert.Error(t, d.validateBackingDir(root))
+
+	d.backingDirRoot = root
+	assert.NoError(t, d.validateBackingDir(root))
+	assert.NoError(t, d.validateBackingDir(filepath.Join(root, "volumes")))
+	assert.Error(t, d.validateBackingDir(outside))
+	assert.Error(t, d.validateBackingDir(root+"-other"))
+	assert.Error(t, d.validateBackingDir(filepath.Join(root, "..", "etc")))
+	assert.Error(t, d.validateBackingDir(filepath.Join(root, "link")))
+	assert.Error(t, d.validateBackingDir(filepath.Join(root, "link", "volumes")))
+}
+
+func TestCreateBackingDevExistingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pvc-1234.img")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("data"), 0600))
+
+	_, err := createBackingDev(file, 1<<20)
+	assert.Error(t, err)
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestRemoveDetachedBackingFiles(t *testing.T) {
+	dir := t.TempDir()
+	attachedFile := filepath.Join(dir, "vol_1.img")
+	detachedFile := filepath.Join(dir, "vol_2.img")
+	for _, file := range []string{attachedFile, detachedFile} {
+		assert.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	}
+	resolved, err := filepath.EvalSymlinks(attachedFile)
+	assert.NoError(t, err)
+
+	kept := removeDetachedBackingFiles([]string{attachedFile, detachedFile, filepath.Join(dir, "missing.img")},
+		map[string]bool{resolved: true})
+	assert.Equal(t, []string{attachedFile}, kept)
+	assert.FileExists(t, attachedFile)
+	assert.NoFileExists(t, detachedFile)
+}
+
+func TestReclaimBackingFile(t *testing.T) {
+	d := NewFakeDriver()
+	d.records = newRecordStore(t.TempDir())
+	dir := t.TempDir()
+
+	// a file the driver did not create is kept
+	foreign := filepath.Join(dir, "vol_1.img")
+	assert.NoError(t, ioutil.WriteFile(foreign, []byte("data"), 0600))
+	assert.Error(t, d.reclaimBackingFile("vol_1", foreign))
+	assert.FileExists(t, foreign)
+	record, err := d.records.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	// a recorded file left behind by a previous stage is removed
+	stale := backingFilePath(dir, "vol_2")
+	assert.NoError(t, d.reclaimBackingFile("vol_2", stale))
+	assert.NoError(t, ioutil.WriteFile(stale, []byte("data"), 0600))
+	assert.NoError(t, d.reclaimBackingFile("vol_2", stale))
+	assert.NoFileExists(t, stale)
+
+	// on start
+	assert.NoError(t, ioutil.WriteFile(stale, []byte("data"), 0600))
+	d.removeStaleBackingFiles()
+	assert.NoFileExists(t, stale)
+	record, err = d.records.Load("vol_2")
+	assert.NoError(t, err)
+	assert.Empty(t, record.BackingFiles)
+
+	// when the volume is deleted
+	assert.NoError(t, d.reclaimBackingFile("vol_2", stale))
+	assert.NoError(t, ioutil.WriteFile(stale, []byte("data"), 0600))
+	_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol_2"})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, stale)
+	record, err = d.records.Load("vol_2")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// blockDeviceFile is written to the staging directory of a raw block volume and holds the
+// path of its zram device, as there is no filesystem mount to find the device from, followed by
+// the boot ID of the node: the staging directory survives a reboot, the device does not.
+const blockDeviceFile = "zram-device"
+
+func writeBlockDeviceFile(stagingPath, devPath string) error {
+	bootID, err := readBootID()
+	if err != nil {
+		klog.Warningf("failed to get boot ID: %v", err)
+	}
+	return ioutil.WriteFile(filepath.Join(stagingPath, blockDeviceFile), []byte(devPath+"\n"+bootID+"\n"), 0644)
+}
+
+// readBlockDeviceFile returns the device recorded in the staging directory and the boot ID it
+// was recorded in, empty if unknown. The error satisfies os.IsNotExist if the volume is not a
+// staged raw block volume.
+func readBlockDeviceFile(stagingPath string) (*ZRAMDevice, string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(stagingPath, blockDeviceFile))
+	if err != nil {
+		return nil, "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	dev, err := NewZRAMDeviceFromDevPath(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, "", err
+	}
+	bootID := ""
+	if len(lines) > 1 {
+		bootID = strings.TrimSpace(lines[1])
+	}
+	return dev, bootID, nil
+}
+
+// stagedBlockDevice returns the device of a raw block volume staged at stagingPath,
+// or nil if the volume is not a raw block volume. A device file that does not belong to the
+// volume anymore, e.g. after a reboot, is removed.
+func (d *Driver) stagedBlockDevice(volumeID, stagingPath string) (*ZRAMDevice, error) {
+	if vol, ok := d.volumes.Get(volumeID); ok && vol.block {
+		return vol.dev, nil
+	}
+	dev, bootID, err := readBlockDeviceFile(stagingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !d.ownsBlockDevice(volumeID, dev, bootID) {
+		klog.Warningf("removing stale %s of volume %s in %s, %s may belong to another volume", blockDeviceFile, volumeID, stagingPath, dev.devPath)
+		if err := os.Remove(filepath.Join(stagingPath, blockDeviceFile)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return dev, nil
+}
+
+// ownsBlockDevice returns true if the device recorded for a raw block volume still belongs to
+// it: the device file was written since the node booted, as zram device ids are reused after a
+// reboot. A device file written without boot ID is checked against the state store, which does
+// not survive a reboot either.
+func (d *Driver) ownsBlockDevice(volumeID string, dev *ZRAMDevice, bootID string) bool {
+	if bootID != "" {
+		current, err := readBootID()
+		if err == nil {
+			return bootID == current
+		}
+		klog.Warningf("failed to get boot ID: %v", err)
+	}
+	state, err := d.state.Load(volumeID)
+	return err == nil && state != nil && state.Block && state.DeviceID == dev.id
+}
+
+// stageBlockVolume creates and sizes the zram device of a raw block volume without formatting it.
+func (d *Driver) stageBlockVolume(volumeID, stagingPath string, context map[string]string, opts *volumeOptions) error {
+	if opts.discardMode != "" {
+		return status.Errorf(codes.InvalidArgument, "%s is not supported for block volumes", discardModeField)
+	}
+	dev, err := d.stagedBlockDevice(volumeID, stagingPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get zram device of staging target %s: %v", stagingPath, err)
+	}
+	if dev != nil && dev.Exists() {
+		klog.V(2).Infof("NodeStageVolume: block volume %s already staged on %s", volumeID, dev.devPath)
+		if _, ok := d.volumes.Get(volumeID); !ok {
+			d.ensureStagedState(volumeID, stagingPath, context, dev, true)
+			capacity, _ := volumeCapacity(context)
+			d.registerVolume(&stagedVolume{volumeID: volumeID, dev: dev, stagingPath: stagingPath, opts: opts, block: true, capacity: capacity})
+		}
+		return nil
+	}
+
+	capacity, err := volumeCapacity(context)
+	if err != nil {
+		return err
+	}
+	source, err := d.volumeContentSource(volumeID, context, capacity, true)
+	if err != nil {
+		return err
+	}
+	gen, err := d.nextGeneration(volumeID, opts)
+	if err != nil {
+		return err
+	}
+	state := newVolumeState(volumeID, stagingPath, context, true)
+	dev, err = d.createVolumeDevice(state, capacity, opts)
+	if err != nil {
+		return err
+	}
+	if source != nil {
+		if err := d.populateVolume(state, dev, source); err != nil {
+			d.abortStage(state)
+			return err
+		}
+	}
+	if err := writeBlockDeviceFile(stagingPath, dev.devPath); err != nil {
+		d.abortStage(state)
+		return status.Errorf(codes.Internal, "failed to record zram device of volume %s in %s: %v", volumeID, stagingPath, err)
+	}
+	if err := d.completeStage(state, gen); err != nil {
+		return err
+	}
+	if source != nil {
+		d.recordPopulated(volumeID)
+	}
+	klog.V(2).Infof("block volume(%s) staged on %q", volumeID, dev.devPath)
+	d.registerVolume(&stagedVolume{volumeID: volumeID, dev: dev, stagingPath: stagingPath, opts: opts, block: true, capacity: capacity})
+	return nil
+}
+
+// publishBlockVolume bind mounts the zram device of a staged raw block volume onto the target file.
+func (d *Driver) publishBlockVolume(volumeID, stagingPath, target string, mountOptions []string) error {
+	dev, err := d.stagedBlockDevice(volumeID, stagingPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get zram device of staging target %s: %v", stagingPath, err)
+	}
+	if dev == nil || !dev.Exists() {
+		return status.Errorf(codes.FailedPrecondition, "block volume %s is not staged on %s", volumeID, stagingPath)
+	}
+
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(target)
+	if err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "failed to check mount point %s: %v", target, err)
+	}
+	if err == nil && !notMnt {
+		klog.V(2).Infof("NodePublishVolume: %s is already mounted", target)
+		return nil
+	}
+	if err := makeFile(target); err != nil {
+		return status.Errorf(codes.Internal, "Could not create target file %q: %v", target, err)
+	}
+
+	klog.V(2).Infof("NodePublishVolume: mounting %s at %s with mountOptions: %v volumeID(%s)", dev.devPath, target, mountOptions, volumeID)
+	if err := d.mounter.Mount(dev.devPath, target, "", mountOptions); err != nil {
+		if removeErr := os.Remove(target); removeErr != nil {
+			return status.Errorf(codes.Internal, "Could not remove mount target %q: %v", target, removeErr)
+		}
+		return status.Errorf(codes.Internal, "Could not mount %q at %q: %v", dev.devPath, target, err)
+	}
+	klog.V(2).Infof("NodePublishVolume: mount %s at %s volumeID(%s) successfully", dev.devPath, target, volumeID)
+	return nil
+}
+
+// makeFile creates an empty file for a bind mount target, together with its parent directory.
+func makeFile(pathname string) error {
+	if err := makeDir(filepath.Dir(pathname)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(pathname, os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
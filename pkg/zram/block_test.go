@@ -0,0 +1,130 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBlockDeviceFile(t *testing.T) {
+	stagingPath := t.TempDir()
+	origBootIDPath := bootIDPath
+	bootIDPath = filepath.Join(t.TempDir(), "boot_id")
+	defer func() { bootIDPath = origBootIDPath }()
+	assert.NoError(t, ioutil.WriteFile(bootIDPath, []byte("boot-1\n"), 0644))
+
+	_, _, err := readBlockDeviceFile(stagingPath)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, writeBlockDeviceFile(stagingPath, "/dev/zram5"))
+	dev, bootID, err := readBlockDeviceFile(stagingPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "boot-1", bootID)
+	assert.Equal(t, 5, dev.GetId())
+	assert.Equal(t, "/dev/zram5", dev.GetDevPath())
+	assert.Equal(t, "/sys/block/zram5", dev.GetSysPath())
+
+	d := NewFakeDriver()
+	dev, err = d.stagedBlockDevice("vol_1", stagingPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, dev.GetId())
+
+	dev, err = d.stagedBlockDevice("vol_1", t.TempDir())
+	assert.NoError(t, err)
+	assert.Nil(t, dev)
+
+	// the device file was written before a reboot, the device may belong to another volume
+	assert.NoError(t, ioutil.WriteFile(bootIDPath, []byte("boot-2\n"), 0644))
+	dev, err = d.stagedBlockDevice("vol_1", stagingPath)
+	assert.NoError(t, err)
+	assert.Nil(t, dev)
+	assert.NoFileExists(t, filepath.Join(stagingPath, blockDeviceFile))
+
+	// device files without boot ID are checked against the state store
+	d.state = newStateStore(t.TempDir())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(stagingPath, blockDeviceFile), []byte("/dev/zram5\n"), 0644))
+	state := newVolumeState("vol_1", stagingPath, nil, true)
+	state.DeviceID = 5
+	assert.NoError(t, d.state.Save(state))
+	dev, err = d.stagedBlockDevice("vol_1", stagingPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, dev.GetId())
+	state.DeviceID = 6
+	assert.NoError(t, d.state.Save(state))
+	dev, err = d.stagedBlockDevice("vol_1", stagingPath)
+	assert.NoError(t, err)
+	assert.Nil(t, dev)
+	assert.NoFileExists(t, filepath.Join(stagingPath, blockDeviceFile))
+}
+
+func TestNewZRAMDeviceFromDevPath(t *testing.T) {
+	dev, err := NewZRAMDeviceFromDevPath("/dev/zram12")
+	assert.NoError(t, err)
+	assert.Equal(t, 12, dev.GetId())
+
+	for _, devPath := range []string{"/dev/loop0", "/dev/zram", "../zramx"} {
+		_, err := NewZRAMDeviceFromDevPath(devPath)
+		assert.Error(t, err, devPath)
+	}
+}
+
+func TestMakeFile(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "publish", "vol_1")
+	assert.NoError(t, makeFile(target))
+	// creating an existing file is a no-op
+	assert.NoError(t, makeFile(target))
+	fi, err := os.Stat(target)
+	assert.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+}
+
+func TestStageBlockVolumeWithDiscard(t *testing.T) {
+	d := NewFakeDriver()
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+		VolumeContext: map[string]string{capacityField: "1048576", "discardMode": "online"},
+	}
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestPublishBlockVolumeNotStaged(t *testing.T) {
+	d := NewFakeDriver()
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: t.TempDir(),
+		TargetPath:        filepath.Join(t.TempDir(), "vol_1"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+	}
+	_, err := d.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
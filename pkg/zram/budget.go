@@ -0,0 +1,170 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// zramBudget bounds the combined disksize of the zram devices staged by the driver.
+// Reservations are keyed by staging path, which is known both when staging and unstaging.
+type zramBudget struct {
+	// limit in bytes, 0 means unlimited
+	limit        int64
+	reservations map[string]int64
+	mux          sync.Mutex
+}
+
+func newZRAMBudget() *zramBudget {
+	return &zramBudget{
+		reservations: make(map[string]int64),
+	}
+}
+
+func (b *zramBudget) SetLimit(limit int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.limit = limit
+}
+
+// Reserve reserves size bytes for the volume staged at stagingPath, it is a no-op if the
+// volume already holds a reservation.
+func (b *zramBudget) Reserve(stagingPath string, size int64) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.reservations[stagingPath]; ok {
+		return nil
+	}
+	reserved := b.reserved()
+	if b.limit > 0 && reserved+size > b.limit {
+		return fmt.Errorf("staging %d bytes would exceed the zram budget of %d bytes, %d bytes are already reserved",
+			size, b.limit, reserved)
+	}
+	b.reservations[stagingPath] = size
+	return nil
+}
+
+// Restore records the reservation of a volume staged before the driver started, regardless of the limit.
+func (b *zramBudget) Restore(stagingPath string, size int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.reservations[stagingPath] = size
+}
+
+func (b *zramBudget) Release(stagingPath string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.reservations, stagingPath)
+}
+
+// Available returns the bytes left in the budget, -1 if unlimited.
+func (b *zramBudget) Available() int64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.limit == 0 {
+		return -1
+	}
+	if available := b.limit - b.reserved(); available > 0 {
+		return available
+	}
+	return 0
+}
+
+func (b *zramBudget) reserved() int64 {
+	var reserved int64
+	for _, size := range b.reservations {
+		reserved += size
+	}
+	return reserved
+}
+
+// budgetLimit returns the zram budget of the node in bytes from the driver options, 0 if unlimited.
+func (d *Driver) budgetLimit() (int64, error) {
+	limit := d.maxTotalZRAMBytes
+	if d.maxTotalZRAMPercent > 0 {
+		info, err := readMemInfo()
+		if err != nil {
+			return 0, err
+		}
+		if percentLimit := int64(float64(info.MemTotal) * d.maxTotalZRAMPercent / 100); limit == 0 || percentLimit < limit {
+			limit = percentLimit
+		}
+	}
+	if limit > 0 {
+		klog.V(2).Infof("zram budget of the node is %d bytes", limit)
+	}
+	return limit, nil
+}
+
+// restoreBudget rebuilds the reservations of the volumes staged before a restart. They are
+// taken from the volumes recovered from the state store, then from the zram filesystems mounted
+// on kubelet staging paths and the device files of raw block volumes, so that volumes staged
+// without a state are accounted for too. Each device is reserved once.
+func (d *Driver) restoreBudget() {
+	staged := make(map[string]*ZRAMDevice)
+	devices := make(map[string]bool)
+	addStaged := func(stagingPath string, dev *ZRAMDevice) {
+		if devices[dev.devPath] {
+			return
+		}
+		if _, ok := staged[stagingPath]; ok {
+			return
+		}
+		staged[stagingPath] = dev
+		devices[dev.devPath] = true
+	}
+	for _, vol := range d.volumes.List() {
+		addStaged(vol.stagingPath, vol.dev)
+	}
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.Errorf("failed to list mount points, zram budget may be underestimated: %v", err)
+	}
+	for _, mp := range mountPoints {
+		if strings.HasPrefix(filepath.Base(mp.Device), "zram") && filepath.Base(mp.Path) == "globalmount" {
+			if dev, err := NewZRAMDeviceFromDevPath(mp.Device); err == nil {
+				addStaged(mp.Path, dev)
+			}
+		}
+	}
+	markers, err := filepath.Glob(filepath.Join(d.kubeletDir, "plugins/kubernetes.io/csi/volumeDevices/staging/*", blockDeviceFile))
+	if err != nil {
+		klog.Errorf("failed to find staged block volumes, zram budget may be underestimated: %v", err)
+	}
+	for _, marker := range markers {
+		// kubelet names the staging directory after the volume
+		stagingPath := filepath.Dir(marker)
+		if dev, err := d.stagedBlockDevice(filepath.Base(stagingPath), stagingPath); err == nil && dev != nil {
+			addStaged(stagingPath, dev)
+		}
+	}
+
+	for stagingPath, dev := range staged {
+		diskSize, err := dev.GetDiskSize()
+		if err != nil {
+			klog.Warningf("failed to get disksize of %s staged on %s: %v", dev.devPath, stagingPath, err)
+			continue
+		}
+		klog.V(2).Infof("restoring zram budget reservation of %d bytes for %s staged on %s", diskSize, dev.devPath, stagingPath)
+		d.budget.Restore(stagingPath, diskSize)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func TestZRAMBudget(t *testing.T) {
+	b := newZRAMBudget()
+	assert.Equal(t, int64(-1), b.Available())
+	assert.NoError(t, b.Reserve("/staging/vol_1", 1<<40))
+	b.Release("/staging/vol_1")
+
+	b.SetLimit(1000)
+	assert.NoError(t, b.Reserve("/staging/vol_1", 600))
+	assert.Equal(t, int64(400), b.Available())
+	// reserving again for the same volume is a no-op
+	assert.NoError(t, b.Reserve("/staging/vol_1", 600))
+	assert.Error(t, b.Reserve("/staging/vol_2", 500))
+	assert.NoError(t, b.Reserve("/staging/vol_2", 400))
+	assert.Equal(t, int64(0), b.Available())
+
+	b.Release("/staging/vol_1")
+	assert.Equal(t, int64(600), b.Available())
+
+	// restored reservations may exceed the limit
+	b.Restore("/staging/vol_3", 2000)
+	assert.Equal(t, int64(0), b.Available())
+	assert.Error(t, b.Reserve("/staging/vol_4", 1))
+}
+
+func TestNodeStageVolumeBudgetExceeded(t *testing.T) {
+	d := NewFakeDriver()
+	d.budget.SetLimit(1 << 20)
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1",
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		},
+		VolumeContext: map[string]string{capacityField: "2097152"},
+	}
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestRestoreBudgetOncePerDevice(t *testing.T) {
+	d := NewFakeDriver()
+	d.kubeletDir = t.TempDir()
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": "4096\n"})
+	// the recovered volume and the mount table name the device by different paths
+	d.volumes.Add(&stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: "/staging/vol_1/globalmount", opts: &volumeOptions{}})
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+		{Device: dev.devPath, Path: "/var/lib/kubelet/staging/vol_1/globalmount"},
+	})}
+
+	d.restoreBudget()
+	assert.Equal(t, map[string]int64{"/staging/vol_1/globalmount": 4096}, d.budget.reservations)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// memInfoPath is replaced in tests.
+var memInfoPath = "/proc/meminfo"
+
+// memInfo holds the fields of /proc/meminfo used for capacity, in bytes.
+type memInfo struct {
+	MemTotal     int64
+	MemAvailable int64
+}
+
+func readMemInfo() (*memInfo, error) {
+	f, err := os.Open(memInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := &memInfo{}
+	found := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var value *int64
+		switch fields[0] {
+		case "MemTotal:":
+			value = &info.MemTotal
+		case "MemAvailable:":
+			value = &info.MemAvailable
+		default:
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q in %s", fields[0], fields[1], memInfoPath)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		*value = v
+		found++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if found < 2 {
+		return nil, fmt.Errorf("MemTotal or MemAvailable missing in %s", memInfoPath)
+	}
+	return info, nil
+}
+
+// reservedMemory returns the memory the zram devices may still allocate: up to their memory
+// limit, or to their disk size divided by the compression ratio when they have no limit.
+// What the devices already use is accounted for in MemAvailable.
+func reservedMemory(devices []*ZRAMDevice, compressionRatio float64) int64 {
+	var reserved int64
+	for _, dev := range devices {
+		diskSize, err := dev.GetDiskSize()
+		if err != nil {
+			klog.Warningf("capacity: failed to get disksize of %s: %v", dev.devPath, err)
+			continue
+		}
+		if diskSize == 0 {
+			continue
+		}
+		mmStat, err := dev.MMStat()
+		if err != nil {
+			klog.Warningf("capacity: failed to get memory statistics of %s: %v", dev.devPath, err)
+			continue
+		}
+		limit := mmStat.MemLimit
+		if limit == 0 {
+			limit = int64(float64(diskSize) / compressionRatio)
+		}
+		if limit > mmStat.MemUsedTotal {
+			reserved += limit - mmStat.MemUsedTotal
+		}
+	}
+	return reserved
+}
+
+// availableCapacity converts the memory left for new volumes into volume capacity.
+func availableCapacity(memAvailable, reserved int64, compressionRatio, overcommit float64) int64 {
+	free := memAvailable - reserved
+	if free <= 0 {
+		return 0
+	}
+	return int64(float64(free) * compressionRatio * overcommit)
+}
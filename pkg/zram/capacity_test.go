@@ -0,0 +1,76 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMemInfo(t *testing.T) {
+	defer func(path string) { memInfoPath = path }(memInfoPath)
+
+	memInfoPath = filepath.Join(t.TempDir(), "meminfo")
+	data := "MemTotal:       16318128 kB\nMemFree:         1268652 kB\nMemAvailable:    8409632 kB\nBuffers:          611876 kB\n"
+	assert.NoError(t, ioutil.WriteFile(memInfoPath, []byte(data), 0644))
+	info, err := readMemInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, &memInfo{MemTotal: 16318128 * 1024, MemAvailable: 8409632 * 1024}, info)
+
+	assert.NoError(t, ioutil.WriteFile(memInfoPath, []byte("MemTotal:       16318128 kB\n"), 0644))
+	_, err = readMemInfo()
+	assert.Error(t, err)
+}
+
+func TestReservedMemory(t *testing.T) {
+	unlimited := newFakeZRAMDevice(t, map[string]string{
+		"disksize": "1048576\n",
+		"mm_stat":  "65536 16384 20480 0 20480 0 0 0\n",
+	})
+	limited := newFakeZRAMDevice(t, map[string]string{
+		"disksize": "1048576\n",
+		"mm_stat":  "65536 16384 20480 102400 20480 0 0 0\n",
+	})
+	full := newFakeZRAMDevice(t, map[string]string{
+		"disksize": "1048576\n",
+		"mm_stat":  "65536 16384 20480 16384 20480 0 0 0\n",
+	})
+	uninitialized := newFakeZRAMDevice(t, map[string]string{"disksize": "0\n"})
+
+	// 1048576 / 2 - 20480 + 102400 - 20480
+	assert.Equal(t, int64(585728), reservedMemory([]*ZRAMDevice{unlimited, limited, full, uninitialized}, 2))
+}
+
+func TestAvailableCapacity(t *testing.T) {
+	assert.Equal(t, int64(3000), availableCapacity(2000, 500, 2, 1))
+	assert.Equal(t, int64(4500), availableCapacity(2000, 500, 2, 1.5))
+	assert.Equal(t, int64(0), availableCapacity(2000, 3000, 2, 1))
+}
+
+func TestGetCapacityOtherNode(t *testing.T) {
+	d := NewFakeDriver()
+	resp, err := d.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		AccessibleTopology: &csi.Topology{Segments: map[string]string{TopologyKeyNode: "other-node"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), resp.AvailableCapacity)
+}
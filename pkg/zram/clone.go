@@ -0,0 +1,245 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+// volumeSource is the content a new volume is filled with when it is staged, either a snapshot
+// or another volume staged on the node.
+type volumeSource struct {
+	snapshot *volumeSnapshot
+	volume   *stagedVolume
+}
+
+// volumeContentSource returns the content source of a volume about to be staged, nil if it is
+// created empty. The content source only applies to the first population of the volume, later
+// stages start empty subject to the data loss policy.
+func (d *Driver) volumeContentSource(volumeID string, context map[string]string, capacity int64, block bool) (*volumeSource, error) {
+	record, err := d.records.Load(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get record of volume %s: %v", volumeID, err)
+	}
+	if record != nil && record.Populated {
+		klog.V(2).Infof("volume %s was already populated from its content source", volumeID)
+		return nil, nil
+	}
+	snap, err := d.restoreSource(context, capacity, block)
+	if err != nil {
+		return nil, err
+	}
+	if snap != nil {
+		return &volumeSource{snapshot: snap}, nil
+	}
+	vol, err := d.cloneSource(volumeID, context, capacity, block)
+	if err != nil {
+		return nil, err
+	}
+	if vol != nil {
+		return &volumeSource{volume: vol}, nil
+	}
+	return nil, nil
+}
+
+// populateVolume fills the new device of a raw block volume being staged from its content source.
+func (d *Driver) populateVolume(state *volumeState, dev *ZRAMDevice, source *volumeSource) error {
+	if source.snapshot != nil {
+		return d.restoreSnapshot(state, dev, source.snapshot)
+	}
+	_, err := d.cloneVolume(state, dev, source.volume)
+	return err
+}
+
+// cloneSource returns the volume a volume is cloned from, nil if it is not a clone. The source
+// must be staged on this node, with the same volume mode, and fit in the capacity of the clone.
+func (d *Driver) cloneSource(volumeID string, context map[string]string, capacity int64, block bool) (*stagedVolume, error) {
+	sourceID := context[sourceVolumeIDField]
+	if sourceID == "" {
+		return nil, nil
+	}
+	if sourceID == volumeID {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s cannot be cloned from itself", volumeID)
+	}
+	vol, ok := d.volumes.Get(sourceID)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "source volume %s is not staged on node %s", sourceID, d.NodeID)
+	}
+	if vol.block != block {
+		return nil, status.Errorf(codes.InvalidArgument, "%s volume %s cannot be cloned to a %s volume",
+			volumeMode(vol.block), sourceID, volumeMode(block))
+	}
+	size, err := vol.dev.GetDiskSize()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get disksize of %s: %v", vol.dev.devPath, err)
+	}
+	if capacity > 0 && size > capacity {
+		return nil, status.Errorf(codes.OutOfRange, "source volume %s of %d bytes does not fit in %d bytes", sourceID, size, capacity)
+	}
+	return vol, nil
+}
+
+// cloneVolume copies the device of a staged volume block by block to the new device of a clone
+// and returns the filesystem type of the copy, empty for raw block volumes. The source is locked
+// during the copy, its filesystem is only frozen while its device is copied. The copied
+// filesystem then gets the label of the clone, so that both volumes are told apart.
+func (d *Driver) cloneVolume(state *volumeState, dev *ZRAMDevice, source *stagedVolume) (string, error) {
+	sourceID := source.volumeID
+	if acquired := d.volumeLocks.TryAcquire(sourceID); !acquired {
+		return "", status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, sourceID)
+	}
+	defer d.volumeLocks.Release(sourceID)
+	// the source may have been unstaged or expanded since it was looked up
+	source, ok := d.volumes.Get(sourceID)
+	if !ok {
+		return "", status.Errorf(codes.NotFound, "source volume %s is not staged on node %s", sourceID, d.NodeID)
+	}
+	size, err := source.dev.GetDiskSize()
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to get disksize of %s: %v", source.dev.devPath, err)
+	}
+	capacity, err := dev.GetDiskSize()
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to get disksize of %s: %v", dev.devPath, err)
+	}
+	if size > capacity {
+		return "", status.Errorf(codes.OutOfRange, "source volume %s of %d bytes does not fit in %d bytes", sourceID, size, capacity)
+	}
+	fsType := ""
+	if !state.Block {
+		mountPoints, err := d.mounter.List()
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "failed to list mount points: %v", err)
+		}
+		mp, ok := findMountPoint(mountPoints, source.stagingPath)
+		if !ok {
+			return "", status.Errorf(codes.Internal, "staging path %s of source volume %s is not mounted", source.stagingPath, sourceID)
+		}
+		fsType = mp.Type
+	}
+
+	if err := d.state.SetIntent(state, intentRestore); err != nil {
+		return "", status.Errorf(codes.Internal, "failed to record state of volume %s: %v", state.VolumeID, err)
+	}
+	start := time.Now()
+	if err := d.freezeVolume(source, func() error {
+		return copyDevice(dev.devPath, source.dev.devPath, size)
+	}); err != nil {
+		return "", status.Errorf(codes.Internal, "failed to clone volume %s to volume %s: %v", sourceID, state.VolumeID, err)
+	}
+	klog.V(2).Infof("NodeStageVolume: volume %s cloned to volume %s on %s in %v",
+		sourceID, state.VolumeID, dev.devPath, time.Since(start).Round(time.Millisecond))
+	if !state.Block {
+		if err := relabelFilesystem(d.mounter.Exec, fsType, volumeLabel(state.VolumeID), dev.devPath); err != nil {
+			return "", status.Errorf(codes.Internal, "failed to relabel clone %s of volume %s: %v", state.VolumeID, sourceID, err)
+		}
+	}
+	return fsType, nil
+}
+
+// growClone grows the filesystem of a clone mounted on its staging path to the size of its
+// device, as the clone may be larger than its source.
+func (d *Driver) growClone(state *volumeState, dev *ZRAMDevice) error {
+	if _, err := mount.NewResizeFs(d.mounter.Exec).Resize(dev.devPath, state.StagingPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to resize filesystem of volume %s: %v", state.VolumeID, err)
+	}
+	return nil
+}
+
+// relabelFilesystem sets the label of a filesystem copied from another volume. xfs and btrfs
+// also get a new UUID, as they refuse to mount a filesystem whose UUID is already mounted.
+func relabelFilesystem(ex exec.Interface, fsType, label, devPath string) error {
+	var cmds [][]string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		cmds = [][]string{{"tune2fs", "-L", label, devPath}}
+	case "xfs":
+		cmds = [][]string{{"xfs_admin", "-L", label, "-U", "generate", devPath}}
+	case "btrfs":
+		cmds = [][]string{{"btrfstune", "-f", "-u", devPath}, {"btrfs", "filesystem", "label", devPath, label}}
+	default:
+		return fmt.Errorf("cannot relabel %s filesystem", fsType)
+	}
+	for _, cmd := range cmds {
+		output, err := ex.Command(cmd[0], cmd[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s failed: %v, output: %s", cmd[0], err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// validateCloneSource checks that a volume can be cloned from a volume staged on this node and
+// returns the disksize of the source.
+func (d *Driver) validateCloneSource(name, sourceID string, volCaps []*csi.VolumeCapability, req *csi.CreateVolumeRequest) (int64, error) {
+	if len(sourceID) == 0 {
+		return 0, status.Error(codes.InvalidArgument, "Volume ID missing in volume content source")
+	}
+	// the source is only on this node, the clone must be allowed here too
+	if d.enableTopology && req.GetAccessibilityRequirements() != nil && !topologyAllowsNode(req.GetAccessibilityRequirements(), d.NodeID) {
+		return 0, status.Errorf(codes.ResourceExhausted, "source volume %s is on node %s, outside of the requested topology", sourceID, d.NodeID)
+	}
+	block := false
+	for _, c := range volCaps {
+		if c.GetBlock() != nil {
+			block = true
+		}
+	}
+	vol, err := d.cloneSource(name, map[string]string{sourceVolumeIDField: sourceID}, 0, block)
+	if err != nil {
+		return 0, err
+	}
+	size, err := vol.dev.GetDiskSize()
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "failed to get disksize of %s: %v", vol.dev.devPath, err)
+	}
+	capacityRange := req.GetCapacityRange()
+	if required := capacityRange.GetRequiredBytes(); required > 0 && required < size {
+		return 0, status.Errorf(codes.OutOfRange, "required capacity %d is smaller than source volume %s of %d bytes", required, sourceID, size)
+	}
+	if limit := capacityRange.GetLimitBytes(); limit > 0 && limit < size {
+		return 0, status.Errorf(codes.OutOfRange, "capacity limit %d is smaller than source volume %s of %d bytes", limit, sourceID, size)
+	}
+	return size, nil
+}
+
+// topologyAllowsNode returns true if the requisite topologies include the node, or if there
+// are none, any preferred topology does.
+func topologyAllowsNode(requirement *csi.TopologyRequirement, nodeID string) bool {
+	topologies := requirement.GetRequisite()
+	if len(topologies) == 0 {
+		topologies = requirement.GetPreferred()
+	}
+	if len(topologies) == 0 {
+		return true
+	}
+	for _, topology := range topologies {
+		if node, ok := topology.GetSegments()[TopologyKeyNode]; ok && node == nodeID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+func TestRelabelFilesystem(t *testing.T) {
+	tests := []struct {
+		fsType       string
+		expectedCmds [][]string
+		expectedErr  bool
+	}{
+		{
+			fsType:       "ext4",
+			expectedCmds: [][]string{{"tune2fs", "-L", "zc0123456789", "/dev/zram1"}},
+		},
+		{
+			fsType:       "xfs",
+			expectedCmds: [][]string{{"xfs_admin", "-L", "zc0123456789", "-U", "generate", "/dev/zram1"}},
+		},
+		{
+			fsType: "btrfs",
+			expectedCmds: [][]string{{"btrfstune", "-f", "-u", "/dev/zram1"},
+				{"btrfs", "filesystem", "label", "/dev/zram1", "zc0123456789"}},
+		},
+		{
+			fsType:      "vfat",
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		var cmds [][]string
+		fakeExec := &testingexec.FakeExec{}
+		for range test.expectedCmds {
+			fakeExec.CommandScript = append(fakeExec.CommandScript, func(cmd string, args ...string) exec.Cmd {
+				cmds = append(cmds, append([]string{cmd}, args...))
+				fakeCmd := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{
+					func() ([]byte, []byte, error) { return nil, nil, nil },
+				}}
+				return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+			})
+		}
+		err := relabelFilesystem(fakeExec, test.fsType, "zc0123456789", "/dev/zram1")
+		assert.Equal(t, test.expectedErr, err != nil, test.fsType)
+		assert.Equal(t, test.expectedCmds, cmds, test.fsType)
+	}
+}
+
+// fakeImageDevice returns a fake zram device of size bytes backed by an image file starting with content.
+func fakeImageDevice(t *testing.T, content string, size int) *ZRAMDevice {
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": fmt.Sprintf("%d\n", size)})
+	dev.devPath = filepath.Join(t.TempDir(), "zram")
+	assert.NoError(t, ioutil.WriteFile(dev.devPath, append([]byte(content), make([]byte, size-len(content))...), 0644))
+	return dev
+}
+
+func TestCloneVolume(t *testing.T) {
+	var frozen []string
+	origFreeze, origThaw := freezeFilesystem, thawFilesystem
+	freezeFilesystem = func(path string) error { frozen = append(frozen, "freeze "+path); return nil }
+	thawFilesystem = func(path string) error { frozen = append(frozen, "thaw "+path); return nil }
+	defer func() { freezeFilesystem, thawFilesystem = origFreeze, origThaw }()
+
+	var relabelled []string
+	fakeExec := &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{
+		func(cmd string, args ...string) exec.Cmd {
+			relabelled = append([]string{cmd}, args...)
+			fakeCmd := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) { return nil, nil, nil },
+			}}
+			return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+		},
+	}}
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/zram0", Path: "/staging/vol_1", Type: "xfs"},
+	}), Exec: fakeExec}
+
+	source := &stagedVolume{volumeID: "vol_1", dev: fakeImageDevice(t, "filesystem", 4096), stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	d.volumes.Add(source)
+
+	// the filesystem of the source is copied with its device while it is frozen, then relabelled
+	state := newVolumeState("vol_2", "/staging/vol_2", nil, false)
+	dev := fakeImageDevice(t, "", 8192)
+	fsType, err := d.cloneVolume(state, dev, source)
+	assert.NoError(t, err)
+	assert.Equal(t, "xfs", fsType)
+	data, err := ioutil.ReadFile(dev.devPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("filesystem"), data[:10])
+	assert.Equal(t, []string{"freeze /staging/vol_1", "thaw /staging/vol_1"}, frozen)
+	assert.Equal(t, []string{"xfs_admin", "-L", volumeLabel("vol_2"), "-U", "generate", dev.devPath}, relabelled)
+
+	d.volumeLocks.TryAcquire("vol_1")
+	_, err = d.cloneVolume(state, dev, source)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	d.volumeLocks.Release("vol_1")
+
+	// the source was expanded beyond the capacity of the clone since it was looked up
+	expanded := &stagedVolume{volumeID: "vol_1", dev: fakeImageDevice(t, "filesystem", 16384), stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	d.volumes.Add(expanded)
+	_, err = d.cloneVolume(state, dev, source)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	d.volumes.Remove("vol_1")
+	_, err = d.cloneVolume(state, dev, source)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// raw block volumes are copied block by block without freezing them
+	blockSource := &stagedVolume{volumeID: "vol_3", dev: fakeImageDevice(t, "block", 4096), opts: &volumeOptions{}, block: true}
+	d.volumes.Add(blockSource)
+	dev = fakeImageDevice(t, "", 8192)
+	fsType, err = d.cloneVolume(newVolumeState("vol_4", "/staging/vol_4", nil, true), dev, blockSource)
+	assert.NoError(t, err)
+	assert.Empty(t, fsType)
+	data, err = ioutil.ReadFile(dev.devPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("block"), data[:5])
+	assert.Len(t, frozen, 2)
+}
+
+func TestVolumeContentSourceClonedOnce(t *testing.T) {
+	d := NewFakeDriver()
+	d.records = newRecordStore(t.TempDir())
+	d.volumes.Add(&stagedVolume{volumeID: "vol_1", dev: newFakeZRAMDevice(t, map[string]string{"disksize": "4096\n"}),
+		stagingPath: "/staging/vol_1", opts: &volumeOptions{}})
+	volumeContext := map[string]string{sourceVolumeIDField: "vol_1"}
+
+	source, err := d.volumeContentSource("vol_2", volumeContext, 4096, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "vol_1", source.volume.volumeID)
+
+	d.recordPopulated("vol_2")
+	d.volumes.Remove("vol_1")
+	// staged again after the source was unstaged
+	source, err = d.volumeContentSource("vol_2", volumeContext, 4096, false)
+	assert.NoError(t, err)
+	assert.Nil(t, source)
+}
+
+func TestCreateVolumeClone(t *testing.T) {
+	d := NewFakeDriver()
+	d.enableTopology = true
+	d.volumes.Add(&stagedVolume{volumeID: "vol_1", dev: newFakeZRAMDevice(t, map[string]string{"disksize": "1048576\n"}),
+		stagingPath: "/staging/vol_1", opts: &volumeOptions{}})
+
+	mountCap := []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}}
+	blockCap := []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}}
+	volumeSource := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: id}},
+		}
+	}
+	nodeTopology := func(node string) *csi.TopologyRequirement {
+		return &csi.TopologyRequirement{Requisite: []*csi.Topology{{Segments: map[string]string{TopologyKeyNode: node}}}}
+	}
+
+	resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+		Parameters: map[string]string{compAlgorithmField: "lz4"}, VolumeContentSource: volumeSource("vol_1"),
+		AccessibilityRequirements: nodeTopology(fakeNodeID)})
+	assert.NoError(t, err)
+	assert.Equal(t, "vol_1", resp.Volume.VolumeContext[sourceVolumeIDField])
+	assert.Equal(t, "lz4", resp.Volume.VolumeContext[compAlgorithmField])
+	assert.Equal(t, "1048576", resp.Volume.VolumeContext[capacityField])
+	assert.Equal(t, "vol_1", resp.Volume.ContentSource.GetVolume().GetVolumeId())
+
+	tests := []struct {
+		desc         string
+		req          *csi.CreateVolumeRequest
+		expectedCode codes.Code
+	}{
+		{
+			desc: "source not staged on node",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				VolumeContentSource: volumeSource("vol_3")},
+			expectedCode: codes.NotFound,
+		},
+		{
+			desc: "source outside of requested topology",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				VolumeContentSource: volumeSource("vol_1"), AccessibilityRequirements: nodeTopology("other-node")},
+			expectedCode: codes.ResourceExhausted,
+		},
+		{
+			desc: "capacity smaller than source",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 4096}, VolumeContentSource: volumeSource("vol_1")},
+			expectedCode: codes.OutOfRange,
+		},
+		{
+			desc: "block clone of filesystem volume",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: blockCap,
+				VolumeContentSource: volumeSource("vol_1")},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc: "clone of itself",
+			req: &csi.CreateVolumeRequest{Name: "vol_1", VolumeCapabilities: mountCap,
+				VolumeContentSource: volumeSource("vol_1")},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc: "source volume ID missing",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				VolumeContentSource: volumeSource("")},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		_, err := d.CreateVolume(context.Background(), test.req)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+	}
+}
+
+func TestTopologyAllowsNode(t *testing.T) {
+	node := func(name string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{TopologyKeyNode: name}}
+	}
+	assert.True(t, topologyAllowsNode(&csi.TopologyRequirement{}, "node-1"))
+	assert.True(t, topologyAllowsNode(&csi.TopologyRequirement{Requisite: []*csi.Topology{node("node-2"), node("node-1")}}, "node-1"))
+	assert.False(t, topologyAllowsNode(&csi.TopologyRequirement{Requisite: []*csi.Topology{node("node-2")},
+		Preferred: []*csi.Topology{node("node-1")}}, "node-1"))
+	assert.True(t, topologyAllowsNode(&csi.TopologyRequirement{Preferred: []*csi.Topology{node("node-1")}}, "node-1"))
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"math"
+
+	"k8s.io/klog/v2"
+)
+
+// fragmentation returns the ratio of the memory used by the device to the size of the
+// compressed data it stores, 1 meaning no fragmentation.
+func fragmentation(stat *MMStat) float64 {
+	if stat.ComprDataSize == 0 {
+		if stat.MemUsedTotal == 0 {
+			return 1
+		}
+		return math.Inf(1)
+	}
+	return float64(stat.MemUsedTotal) / float64(stat.ComprDataSize)
+}
+
+// compactVolumes compacts the staged devices whose fragmentation reached the threshold,
+// or all of them when the threshold is not set.
+func (d *Driver) compactVolumes() {
+	for _, vol := range d.volumes.List() {
+		compactDevice(vol.volumeID, vol.dev, d.compactFragmentationThreshold)
+	}
+}
+
+func compactDevice(volumeID string, dev *ZRAMDevice, threshold float64) {
+	before, err := dev.MMStat()
+	if err != nil {
+		klog.Warningf("compact: failed to get memory statistics of %s: %v", dev.devPath, err)
+		return
+	}
+	ratio := fragmentation(before)
+	if threshold > 0 && ratio < threshold {
+		klog.V(6).Infof("compact: skip %s of volume %s, fragmentation %.2f below %.2f", dev.devPath, volumeID, ratio, threshold)
+		return
+	}
+	if err := dev.Compact(); err != nil {
+		klog.Warningf("compact: failed to compact %s of volume %s: %v", dev.devPath, volumeID, err)
+		return
+	}
+	after, err := dev.MMStat()
+	if err != nil {
+		klog.Warningf("compact: failed to get memory statistics of %s: %v", dev.devPath, err)
+		return
+	}
+	klog.V(2).Infof("compact: %s of volume %s, fragmentation %.2f, mem_used_total %d -> %d bytes, %d pages compacted",
+		dev.devPath, volumeID, ratio, before.MemUsedTotal, after.MemUsedTotal, after.PagesCompacted-before.PagesCompacted)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentation(t *testing.T) {
+	assert.Equal(t, 1.0, fragmentation(&MMStat{}))
+	assert.True(t, math.IsInf(fragmentation(&MMStat{MemUsedTotal: 4096}), 1))
+	assert.Equal(t, 1.5, fragmentation(&MMStat{ComprDataSize: 4096, MemUsedTotal: 6144}))
+}
+
+func TestCompactDevice(t *testing.T) {
+	tests := []struct {
+		desc            string
+		mmStat          string
+		threshold       float64
+		expectedCompact string
+	}{
+		{
+			desc:            "no threshold",
+			mmStat:          "8192 4096 4096 0 4096 0 0 0 0",
+			expectedCompact: "1",
+		},
+		{
+			desc:            "fragmentation above threshold",
+			mmStat:          "8192 4096 8192 0 8192 0 0 0 0",
+			threshold:       1.5,
+			expectedCompact: "1",
+		},
+		{
+			desc:      "fragmentation below threshold",
+			mmStat:    "8192 4096 4096 0 4096 0 0 0 0",
+			threshold: 1.5,
+		},
+	}
+
+	for _, test := range tests {
+		dev := newFakeZRAMDevice(t, map[string]string{"mm_stat": test.mmStat, "compact": ""})
+		compactDevice("vol", dev, test.threshold)
+
+		compact, err := ioutil.ReadFile(filepath.Join(dev.sysPath, "compact"))
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedCompact, string(compact), test.desc)
+	}
+}
@@ -20,10 +20,13 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2"
 )
 
@@ -43,8 +46,64 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if parameters == nil {
 		parameters = make(map[string]string)
 	}
+	// the content source is carried to the node in the volume context, never taken from the StorageClass
+	delete(parameters, snapshotIDField)
+	delete(parameters, sourceVolumeIDField)
+	contentSource := req.GetVolumeContentSource()
+	if contentSource != nil {
+		var size int64
+		var err error
+		switch {
+		case contentSource.GetSnapshot() != nil:
+			snapshotID := contentSource.GetSnapshot().GetSnapshotId()
+			size, err = d.validateSnapshotSource(snapshotID, volumeCapabilities, req.GetCapacityRange())
+			parameters[snapshotIDField] = snapshotID
+		case contentSource.GetVolume() != nil:
+			sourceID := contentSource.GetVolume().GetVolumeId()
+			size, err = d.validateCloneSource(name, sourceID, volumeCapabilities, req)
+			parameters[sourceVolumeIDField] = sourceID
+		default:
+			return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if reqCapacity == 0 {
+			reqCapacity = size
+		}
+	}
 	parameters[capacityField] = strconv.FormatInt(reqCapacity, 10)
 
+	opts, err := parseVolumeOptions(parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if opts.backingDir != "" {
+		if err := d.validateBackingDir(opts.backingDir); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if opts.discardMode != "" {
+		for _, c := range volumeCapabilities {
+			if c.GetBlock() != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%s is not supported for block volumes", discardModeField)
+			}
+		}
+	}
+	if compAlgorithms := opts.compAlgorithms(); len(compAlgorithms) > 0 {
+		// the controller runs on the node, so check against the local kernel when a zram device is present
+		algorithms, err := GetNodeCompAlgorithms()
+		if err != nil {
+			klog.Warningf("CreateVolume: failed to get supported compression algorithms: %v", err)
+		} else if algorithms != nil {
+			for _, algorithm := range compAlgorithms {
+				if err := validateCompAlgorithm(algorithm, algorithms); err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+			}
+		}
+	}
+
 	topologies := []*csi.Topology{}
 	if d.enableTopology {
 		topologies = append(topologies, &csi.Topology{Segments: map[string]string{TopologyKeyNode: d.NodeID}})
@@ -54,6 +113,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		CapacityBytes:      0, // by setting it to zero, Provisioner will use PVC requested size as PV size
 		VolumeId:           name,
 		VolumeContext:      parameters,
+		ContentSource:      contentSource,
 		AccessibleTopology: topologies,
 	}
 	klog.V(2).Infof("CreateVolume: name(%v) volumeCapabilities(%v) reqCapacity(%v) parameters(%v)",
@@ -68,12 +128,50 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "volume id is empty")
 	}
 	klog.V(2).Infof("DeleteVolume: name(%v)", name)
+	record, err := d.records.Load(name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get record of volume %s: %v", name, err)
+	}
+	if record != nil && len(record.BackingFiles) > 0 {
+		attached, err := attachedBackingFiles()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list backing files of loop devices: %v", err)
+		}
+		if kept := removeDetachedBackingFiles(record.BackingFiles, attached); len(kept) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "backing files %v of volume %s are still in use or could not be removed", kept, name)
+		}
+	}
+	if err := d.records.Delete(name); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete record of volume %s: %v", name, err)
+	}
+	if err := d.generations.Delete(name); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete generation of volume %s: %v", name, err)
+	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-// ControllerGetVolume get volume
-func (d *Driver) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// ControllerGetVolume returns a volume staged on this node, the controller runs on every node and
+// only knows the volumes of its own node.
+func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	vol, ok := d.volumes.Get(volumeID)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not staged on node %s", volumeID, d.NodeID)
+	}
+	entry, err := d.volumeEntry(vol)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: entry.Volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: entry.Status.PublishedNodeIds,
+			VolumeCondition:  entry.Status.VolumeCondition,
+		},
+	}, nil
 }
 
 func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
@@ -109,29 +207,237 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 
 // GetCapacity returns the capacity of the total available storage pool
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	// the controller runs on every node and only reports the memory of its own node
+	if segments := req.GetAccessibleTopology().GetSegments(); segments != nil {
+		if node, ok := segments[TopologyKeyNode]; ok && node != d.NodeID {
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+
+	info, err := readMemInfo()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read memory information: %v", err)
+	}
+	devices, err := ListZRAMDevices()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list zram devices: %v", err)
+	}
+	reserved := reservedMemory(devices, d.capacityCompressionRatio)
+	available := availableCapacity(info.MemAvailable, reserved, d.capacityCompressionRatio, d.capacityOvercommit)
+	if budget := d.budget.Available(); budget >= 0 && budget < available {
+		available = budget
+	}
+	// the scheduler prefers the maximum volume size over the capacity when it is set, a single
+	// volume is bounded by the free capacity and cannot hold more than the node memory
+	maximum := int64(float64(info.MemTotal) * d.capacityCompressionRatio)
+	if available < maximum {
+		maximum = available
+	}
+	klog.V(4).Infof("GetCapacity: MemTotal %d, MemAvailable %d, reserved by zram devices %d, available capacity %d, maximum volume size %d",
+		info.MemTotal, info.MemAvailable, reserved, available, maximum)
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: &wrappers.Int64Value{Value: maximum},
+	}, nil
 }
 
-// ListVolumes return all available volumes
+// ListVolumes returns the volumes staged on this node sorted by volume ID. The starting token is
+// the index of the first volume to return.
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+	volumes := d.volumes.List()
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(volumes) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+	end := len(volumes)
+	if max := int(req.GetMaxEntries()); max > 0 && start+max < end {
+		end = start + max
+	}
+
+	resp := &csi.ListVolumesResponse{}
+	for _, vol := range volumes[start:end] {
+		entry, err := d.volumeEntry(vol)
+		if err != nil {
+			return nil, err
+		}
+		resp.Entries = append(resp.Entries, entry)
+	}
+	if end < len(volumes) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
 }
 
-// ControllerExpandVolume expand volume
+// ControllerExpandVolume accepts the new capacity, the volume is moved to a larger zram device
+// by NodeExpandVolume.
 func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	if capacity <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Required capacity missing in request")
+	}
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && limit < capacity {
+		return nil, status.Errorf(codes.InvalidArgument, "required capacity %d exceeds the limit %d", capacity, limit)
+	}
+	klog.V(2).Infof("ControllerExpandVolume: volume %s to %d bytes", volumeID, capacity)
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacity, NodeExpansionRequired: true}, nil
 }
 
+// CreateSnapshot archives a volume staged on this node under the snapshot directory. The
+// snapshot ID is the snapshot name.
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if d.snapshots.dir == "" {
+		return nil, status.Error(codes.Unimplemented, "snapshots are disabled")
+	}
+	name := req.GetName()
+	if len(name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot name must be provided")
+	}
+	volumeID := req.GetSourceVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot source volume ID must be provided")
+	}
+
+	// the snapshot is locked against a concurrent DeleteSnapshot, the volume while it is copied
+	if acquired := d.volumeLocks.TryAcquire(snapshotLockKey(name)); !acquired {
+		return nil, status.Errorf(codes.Aborted, snapshotOperationAlreadyExistsFmt, name)
+	}
+	defer d.volumeLocks.Release(snapshotLockKey(name))
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	snap, err := d.snapshots.Load(name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get snapshot %s: %v", name, err)
+	}
+	if snap != nil {
+		if snap.SourceVolumeID != volumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", name, snap.SourceVolumeID)
+		}
+	} else {
+		vol, ok := d.volumes.Get(volumeID)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "volume %s is not staged on node %s", volumeID, d.NodeID)
+		}
+		if snap, err = d.createSnapshot(vol, name); err != nil {
+			return nil, err
+		}
+	}
+	snapshot, err := csiSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
 }
 
+// DeleteSnapshot removes the archive of a snapshot, snapshots that are not on this node are
+// considered deleted.
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if d.snapshots.dir == "" {
+		return nil, status.Error(codes.Unimplemented, "snapshots are disabled")
+	}
+	snapshotID := req.GetSnapshotId()
+	if len(snapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+	if acquired := d.volumeLocks.TryAcquire(snapshotLockKey(snapshotID)); !acquired {
+		return nil, status.Errorf(codes.Aborted, snapshotOperationAlreadyExistsFmt, snapshotID)
+	}
+	defer d.volumeLocks.Release(snapshotLockKey(snapshotID))
+
+	if err := d.snapshots.Delete(snapshotID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete snapshot %s: %v", snapshotID, err)
+	}
+	klog.V(2).Infof("DeleteSnapshot: snapshot %s deleted", snapshotID)
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// ListSnapshots returns the snapshots on this node sorted by snapshot ID, filtered by snapshot
+// or source volume ID. The starting token is the index of the first snapshot to return.
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if d.snapshots.dir == "" {
+		return nil, status.Error(codes.Unimplemented, "snapshots are disabled")
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+	all, err := d.snapshots.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list snapshots: %v", err)
+	}
+	var snaps []*volumeSnapshot
+	for _, snap := range all {
+		if id := req.GetSnapshotId(); id != "" && snap.SnapshotID != id {
+			continue
+		}
+		if id := req.GetSourceVolumeId(); id != "" && snap.SourceVolumeID != id {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(snaps) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+	end := len(snaps)
+	if max := int(req.GetMaxEntries()); max > 0 && start+max < end {
+		end = start + max
+	}
+
+	resp := &csi.ListSnapshotsResponse{}
+	for _, snap := range snaps[start:end] {
+		snapshot, err := csiSnapshot(snap)
+		if err != nil {
+			return nil, err
+		}
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+	if end < len(snaps) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+// validateSnapshotSource checks that a volume can be restored from a snapshot on this node and
+// returns the size of the snapshot.
+func (d *Driver) validateSnapshotSource(snapshotID string, volCaps []*csi.VolumeCapability, capacityRange *csi.CapacityRange) (int64, error) {
+	if len(snapshotID) == 0 {
+		return 0, status.Error(codes.InvalidArgument, "Snapshot ID missing in volume content source")
+	}
+	block := false
+	for _, c := range volCaps {
+		if c.GetBlock() != nil {
+			block = true
+		}
+	}
+	snap, err := d.restoreSource(map[string]string{snapshotIDField: snapshotID}, 0, block)
+	if err != nil {
+		return 0, err
+	}
+	if required := capacityRange.GetRequiredBytes(); required > 0 && required < snap.SizeBytes {
+		return 0, status.Errorf(codes.OutOfRange, "required capacity %d is smaller than snapshot %s of %d bytes", required, snapshotID, snap.SizeBytes)
+	}
+	if limit := capacityRange.GetLimitBytes(); limit > 0 && limit < snap.SizeBytes {
+		return 0, status.Errorf(codes.OutOfRange, "capacity limit %d is smaller than snapshot %s of %d bytes", limit, snapshotID, snap.SizeBytes)
+	}
+	return snap.SizeBytes, nil
 }
 
 // isValidVolumeCapabilities validates the given VolumeCapability array is valid
@@ -139,10 +445,77 @@ func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
 	if len(volCaps) == 0 {
 		return fmt.Errorf("volume capabilities missing in request")
 	}
-	for _, c := range volCaps {
-		if c.GetBlock() != nil {
-			return fmt.Errorf("block volume capability not supported")
+	return nil
+}
+
+// volumeEntry describes a staged volume. Its context holds the parameters it was staged with and
+// the paths it is published on, comma separated.
+func (d *Driver) volumeEntry(vol *stagedVolume) (*csi.ListVolumesResponse_Entry, error) {
+	capacity := vol.capacity
+	if diskSize, err := vol.dev.GetDiskSize(); err == nil && diskSize > 0 {
+		capacity = diskSize
+	}
+	context := make(map[string]string)
+	state, err := d.state.Load(vol.volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get state of volume %s: %v", vol.volumeID, err)
+	}
+	if state != nil {
+		for k, v := range state.Parameters {
+			context[k] = v
 		}
 	}
-	return nil
+	targets, err := d.publishedPaths(vol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get publish targets of volume %s: %v", vol.volumeID, err)
+	}
+	var publishedNodeIDs []string
+	if len(targets) > 0 {
+		context[publishTargetsField] = strings.Join(targets, ",")
+		publishedNodeIDs = []string{d.NodeID}
+	}
+
+	volume := &csi.Volume{
+		VolumeId:      vol.volumeID,
+		CapacityBytes: capacity,
+		VolumeContext: context,
+	}
+	if snapshotID := context[snapshotIDField]; snapshotID != "" {
+		volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID}},
+		}
+	} else if sourceID := context[sourceVolumeIDField]; sourceID != "" {
+		volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID}},
+		}
+	}
+	if d.enableTopology {
+		volume.AccessibleTopology = []*csi.Topology{{Segments: map[string]string{TopologyKeyNode: d.NodeID}}}
+	}
+	return &csi.ListVolumesResponse_Entry{
+		Volume: volume,
+		Status: &csi.ListVolumesResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs,
+			VolumeCondition:  d.volumeCondition(vol.volumeID, vol.stagingPath, vol.stagingPath, vol.block),
+		},
+	}, nil
+}
+
+// publishedPaths returns the recorded publish targets of a volume together with the other mounts
+// of its device, sorted.
+func (d *Driver) publishedPaths(vol *stagedVolume) ([]string, error) {
+	paths := sets.NewString()
+	for target := range vol.publishTargets() {
+		paths.Insert(target)
+	}
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, mp := range mountPoints {
+		if mp.Device == vol.dev.devPath && (vol.block || mp.Path != vol.stagingPath) {
+			paths.Insert(mp.Path)
+		}
+	}
+	return paths.List(), nil
 }
@@ -0,0 +1,95 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eventTypeNormal  = corev1.EventTypeNormal
+	eventTypeWarning = corev1.EventTypeWarning
+)
+
+// eventRecorder records Kubernetes events on the PersistentVolume of a volume, which is named
+// after the volume ID.
+type eventRecorder interface {
+	Event(volumeID, eventType, reason, message string)
+}
+
+// logEventRecorder only logs the events, used outside of a cluster.
+type logEventRecorder struct{}
+
+func (logEventRecorder) Event(volumeID, eventType, reason, message string) {
+	klog.V(4).Infof("event %s %s on volume %s: %s", eventType, reason, volumeID, message)
+}
+
+// kubeEventRecorder records the events with the service account of the pod through an event
+// broadcaster, which aggregates and retries them in the background.
+type kubeEventRecorder struct {
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+}
+
+// newEventRecorder returns a recorder creating events in the cluster the plugin runs in, or
+// one that only logs them if the plugin does not run in a pod.
+func newEventRecorder(component, nodeID string) eventRecorder {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		klog.V(2).Infof("not running in a cluster, events are only logged: %v", err)
+		return logEventRecorder{}
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Warningf("failed to create Kubernetes client, events are only logged: %v", err)
+		return logEventRecorder{}
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &kubeEventRecorder{
+		client:   client,
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component, Host: nodeID}),
+	}
+}
+
+// Event records an event on the PersistentVolume of the volume. Its UID is looked up so that
+// the event is listed by kubectl describe, the event only names the volume if that fails.
+func (r *kubeEventRecorder) Event(volumeID, eventType, reason, message string) {
+	ref := &corev1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: volumeID}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if pv, err := r.client.CoreV1().PersistentVolumes().Get(ctx, volumeID, metav1.GetOptions{}); err != nil {
+		klog.Warningf("failed to get PersistentVolume %s: %v", volumeID, err)
+	} else if pvRef, err := reference.GetReference(scheme.Scheme, pv); err != nil {
+		klog.Warningf("failed to get reference of PersistentVolume %s: %v", volumeID, err)
+	} else {
+		ref = pvRef
+	}
+	r.recorder.Event(ref, eventType, reason, message)
+}
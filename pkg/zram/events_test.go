@@ -0,0 +1,56 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// refRecorder keeps the object references and reasons of the events recorded.
+type refRecorder struct {
+	record.EventRecorder
+	refs    []*corev1.ObjectReference
+	reasons []string
+}
+
+func (r *refRecorder) Event(object runtime.Object, eventType, reason, message string) {
+	r.refs = append(r.refs, object.(*corev1.ObjectReference))
+	r.reasons = append(r.reasons, eventType+" "+reason)
+}
+
+func TestKubeEventRecorder(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "vol_1", UID: "1234"}})
+	recorder := &refRecorder{}
+	r := &kubeEventRecorder{client: client, recorder: recorder}
+
+	r.Event("vol_1", eventTypeWarning, eventReasonReadOnly, "read-only")
+	// the event only names a volume whose PersistentVolume cannot be found
+	r.Event("vol_2", eventTypeNormal, eventReasonReadWrite, "read-write")
+
+	assert.Equal(t, []string{"Warning " + eventReasonReadOnly, "Normal " + eventReasonReadWrite}, recorder.reasons)
+	assert.Equal(t, "PersistentVolume", recorder.refs[0].Kind)
+	assert.Equal(t, "vol_1", recorder.refs[0].Name)
+	assert.Equal(t, "1234", string(recorder.refs[0].UID))
+	assert.Equal(t, &corev1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: "vol_2"}, recorder.refs[1])
+}
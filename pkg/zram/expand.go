@@ -0,0 +1,225 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// copyChunkSize is the size of the blocks copied between devices, blocks of zeros are skipped
+// as the new device reads zeros where nothing was written.
+const copyChunkSize = 1 << 20
+
+// copyDevice copies the first size bytes of the src block device to dst.
+func copyDevice(dst, src string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, copyChunkSize)
+	zeros := make([]byte, copyChunkSize)
+	for offset := int64(0); offset < size; {
+		n, err := io.ReadFull(in, buf[:min64(copyChunkSize, size-offset)])
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to read %s at %d: %v", src, offset, err)
+		}
+		if !bytes.Equal(buf[:n], zeros[:n]) {
+			if _, err := out.WriteAt(buf[:n], offset); err != nil {
+				out.Close()
+				return fmt.Errorf("failed to write %s at %d: %v", dst, offset, err)
+			}
+		}
+		offset += int64(n)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// expandBudgetKey holds the reservation of the larger device while a volume is migrated, as
+// both devices exist until the old one is removed.
+func expandBudgetKey(stagingPath string) string {
+	return stagingPath + "#expand"
+}
+
+// expandVolume migrates a staged volume that is not published to a new zram device of the given
+// capacity, as the disksize of a device cannot change. The filesystem is unmounted, copied block
+// by block, mounted from the new device and grown. The new device is recorded in the state store
+// before anything is changed, so that an interrupted expansion is rolled back on start.
+func (d *Driver) expandVolume(vol *stagedVolume, capacity int64) error {
+	oldSize, err := vol.dev.GetDiskSize()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get disksize of %s: %v", vol.dev.devPath, err)
+	}
+	state, err := d.state.Load(vol.volumeID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get state of volume %s: %v", vol.volumeID, err)
+	}
+	if state == nil {
+		state = newVolumeState(vol.volumeID, vol.stagingPath, nil, vol.block)
+		state.DeviceID = vol.dev.id
+		state.Phase = phaseStaged
+	}
+
+	if err := d.budget.Reserve(expandBudgetKey(vol.stagingPath), capacity); err != nil {
+		return status.Errorf(codes.ResourceExhausted, "Volume(%s): %v", vol.volumeID, err)
+	}
+	newDev, err := NewZRAMDevice()
+	if err != nil {
+		d.budget.Release(expandBudgetKey(vol.stagingPath))
+		return status.Errorf(codes.Internal, "Failed to create zram device: %v", err)
+	}
+	expandDeviceID := newDev.id
+	state.ExpandDeviceID = &expandDeviceID
+	if err := d.state.SetIntent(state, intentExpand); err != nil {
+		d.abortExpansion(vol, state, newDev)
+		return status.Errorf(codes.Internal, "failed to record state of volume %s: %v", vol.volumeID, err)
+	}
+	// the backing file of the old device is in use until the migration completes
+	backingName := fmt.Sprintf("%s#zram%d", vol.volumeID, newDev.id)
+	if err := d.configureZRAMDevice(newDev, vol.volumeID, backingName, capacity, vol.opts); err != nil {
+		d.abortExpansion(vol, state, newDev)
+		return err
+	}
+
+	d.volumeTasks.Stop(vol.volumeID)
+	if !vol.block {
+		if err := d.mounter.Unmount(vol.stagingPath); err != nil {
+			d.abortExpansion(vol, state, newDev)
+			return status.Errorf(codes.Internal, "failed to unmount %s: %v", vol.stagingPath, err)
+		}
+	}
+	klog.V(2).Infof("NodeExpandVolume: copying %d bytes of volume %s from %s to %s", oldSize, vol.volumeID, vol.dev.devPath, newDev.devPath)
+	if err := copyDevice(newDev.devPath, vol.dev.devPath, oldSize); err != nil {
+		d.abortExpansion(vol, state, newDev)
+		return status.Errorf(codes.Internal, "failed to copy volume %s: %v", vol.volumeID, err)
+	}
+	if vol.block {
+		if err := writeBlockDeviceFile(vol.stagingPath, newDev.devPath); err != nil {
+			d.abortExpansion(vol, state, newDev)
+			return status.Errorf(codes.Internal, "failed to record zram device of volume %s in %s: %v", vol.volumeID, vol.stagingPath, err)
+		}
+	} else {
+		if err := d.mounter.Mount(newDev.devPath, vol.stagingPath, "", vol.mountOptions); err != nil {
+			d.abortExpansion(vol, state, newDev)
+			return status.Errorf(codes.Internal, "failed to mount %s on %s: %v", newDev.devPath, vol.stagingPath, err)
+		}
+		if _, err := mount.NewResizeFs(d.mounter.Exec).Resize(newDev.devPath, vol.stagingPath); err != nil {
+			d.abortExpansion(vol, state, newDev)
+			return status.Errorf(codes.Internal, "failed to resize filesystem of volume %s: %v", vol.volumeID, err)
+		}
+		// the filesystem is grown read-write, then kept read-only if the memory watchdog made it so
+		if vol.isReadOnly() {
+			if err := d.mounter.Mount(newDev.devPath, vol.stagingPath, "", []string{"remount", "ro"}); err != nil {
+				d.abortExpansion(vol, state, newDev)
+				return status.Errorf(codes.Internal, "failed to remount %s read-only: %v", vol.stagingPath, err)
+			}
+		}
+	}
+
+	// the volume is on the new device from here on
+	parameters := make(map[string]string, len(state.Parameters)+1)
+	for k, v := range state.Parameters {
+		parameters[k] = v
+	}
+	parameters[capacityField] = strconv.FormatInt(capacity, 10)
+	state.Parameters = parameters
+	state.DeviceID = newDev.id
+	state.ExpandDeviceID = nil
+	if err := d.state.SetIntent(state, ""); err != nil {
+		klog.Errorf("failed to record state of volume %s: %v", vol.volumeID, err)
+	}
+	d.budget.Release(expandBudgetKey(vol.stagingPath))
+	d.budget.Restore(vol.stagingPath, capacity)
+	if err := releaseZRAMDevice(vol.dev); err != nil {
+		klog.Errorf("failed to remove device %s of volume %s after expansion: %v", vol.dev.devPath, vol.volumeID, err)
+	}
+
+	expanded := &stagedVolume{volumeID: vol.volumeID, dev: newDev, stagingPath: vol.stagingPath, opts: vol.opts, block: vol.block,
+		capacity: capacity, mountOptions: vol.mountOptions, targets: vol.publishTargets()}
+	d.registerVolume(expanded)
+	klog.V(2).Infof("NodeExpandVolume: volume %s moved from %s to %s of %d bytes", vol.volumeID, vol.dev.devPath, newDev.devPath, capacity)
+	return nil
+}
+
+// abortExpansion removes the new device of a failed expansion and puts the volume back on its
+// previous device.
+func (d *Driver) abortExpansion(vol *stagedVolume, state *volumeState, newDev *ZRAMDevice) {
+	if err := d.rollbackExpansion(state, newDev, vol.stagingMountOptions()); err != nil {
+		klog.Errorf("failed to roll back expansion of volume %s: %v", vol.volumeID, err)
+	}
+	d.budget.Release(expandBudgetKey(vol.stagingPath))
+	d.registerVolume(vol)
+}
+
+// rollbackExpansion removes the new device of an expansion, mounts the previous device on the
+// staging path again if needed and clears the intent.
+func (d *Driver) rollbackExpansion(state *volumeState, newDev *ZRAMDevice, mountOptions []string) error {
+	if newDev.Exists() {
+		if !state.Block {
+			if err := newDev.UnmountAndCleanup(); err != nil {
+				return fmt.Errorf("failed to unmount %s: %v", newDev.devPath, err)
+			}
+		}
+		if err := releaseZRAMDevice(newDev); err != nil {
+			return fmt.Errorf("failed to remove device %s: %v", newDev.devPath, err)
+		}
+	}
+	oldDev, _ := NewZRAMDeviceFromId(state.DeviceID)
+	if state.Block {
+		if err := writeBlockDeviceFile(state.StagingPath, oldDev.devPath); err != nil {
+			return err
+		}
+	} else {
+		mountPoints, err := d.mounter.List()
+		if err != nil {
+			return err
+		}
+		if mp, ok := findMountPoint(mountPoints, state.StagingPath); !ok || mp.Device != oldDev.devPath {
+			if err := d.mounter.Mount(oldDev.devPath, state.StagingPath, "", mountOptions); err != nil {
+				return fmt.Errorf("failed to mount %s on %s: %v", oldDev.devPath, state.StagingPath, err)
+			}
+		}
+	}
+	state.ExpandDeviceID = nil
+	return d.state.SetIntent(state, "")
+}
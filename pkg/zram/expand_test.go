@@ -0,0 +1,60 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyDevice(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	data := make([]byte, 3*copyChunkSize+4096)
+	copy(data, "superblock")
+	copy(data[2*copyChunkSize+100:], "file")
+	copy(data[3*copyChunkSize:], "tail")
+	assert.NoError(t, ioutil.WriteFile(src, data, 0600))
+	f, err := os.Create(dst)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Truncate(8*copyChunkSize))
+	assert.NoError(t, f.Close())
+
+	assert.NoError(t, copyDevice(dst, src, int64(len(data))))
+	copied, err := ioutil.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Len(t, copied, 8*copyChunkSize)
+	assert.True(t, bytes.Equal(data, copied[:len(data)]))
+
+	// the source is smaller than its disksize
+	assert.Error(t, copyDevice(dst, src, int64(len(data))+1))
+}
+
+func TestPageAlign(t *testing.T) {
+	pageSize := int64(os.Getpagesize())
+	assert.Equal(t, int64(0), pageAlign(0))
+	assert.Equal(t, pageSize, pageAlign(1))
+	assert.Equal(t, pageSize, pageAlign(pageSize))
+	assert.Equal(t, 2*pageSize, pageAlign(pageSize+1))
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"sync/atomic"
+
+	"github.com/boris257/csi-driver-zram/pkg/fs"
+	"k8s.io/klog/v2"
+)
+
+// trimFilesystem is replaced in tests.
+var trimFilesystem = fs.Trim
+
+// trimVolume discards the blocks freed by the filesystem of a staged volume so that
+// zram releases the memory holding deleted data.
+func trimVolume(vol *stagedVolume) {
+	trimmed, err := trimFilesystem(vol.stagingPath)
+	if err != nil {
+		klog.Warningf("fstrim: failed to trim %s of volume %s: %v", vol.stagingPath, vol.volumeID, err)
+		return
+	}
+	total := atomic.AddUint64(&vol.trimmedBytes, trimmed)
+	klog.V(2).Infof("fstrim: %s of volume %s, %d bytes trimmed, %d bytes in total", vol.stagingPath, vol.volumeID, trimmed, total)
+}
+
+// recordTrimmedBytes keeps the number of bytes trimmed from a volume in its record, so that the
+// counter survives a restart of the node plugin. It is skipped while an operation is in
+// progress on the volume, the next run records the total.
+func (d *Driver) recordTrimmedBytes(vol *stagedVolume) {
+	if acquired := d.volumeLocks.TryAcquire(vol.volumeID); !acquired {
+		return
+	}
+	defer d.volumeLocks.Release(vol.volumeID)
+
+	state, err := d.state.Load(vol.volumeID)
+	if err != nil || state == nil {
+		return
+	}
+	state.TrimmedBytes = atomic.LoadUint64(&vol.trimmedBytes)
+	if err := d.state.Save(state); err != nil {
+		klog.Warningf("fstrim: failed to record state of volume %s: %v", vol.volumeID, err)
+	}
+}
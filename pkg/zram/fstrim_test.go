@@ -0,0 +1,63 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimVolume(t *testing.T) {
+	defer func(trim func(string) (uint64, error)) { trimFilesystem = trim }(trimFilesystem)
+
+	vol := &stagedVolume{volumeID: "vol_1", stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	trimFilesystem = func(path string) (uint64, error) {
+		assert.Equal(t, vol.stagingPath, path)
+		return 4096, nil
+	}
+	trimVolume(vol)
+	trimVolume(vol)
+	assert.Equal(t, uint64(8192), vol.trimmedBytes)
+
+	trimFilesystem = func(path string) (uint64, error) {
+		return 0, fmt.Errorf("operation not supported")
+	}
+	trimVolume(vol)
+	assert.Equal(t, uint64(8192), vol.trimmedBytes)
+}
+
+func TestTrimmedBytesKept(t *testing.T) {
+	d := NewFakeDriver()
+	d.state = newStateStore(t.TempDir())
+	state := newVolumeState("vol_1", "/staging/vol_1", nil, false)
+	state.Phase = phaseStaged
+	assert.NoError(t, d.state.Save(state))
+
+	vol := &stagedVolume{volumeID: "vol_1", stagingPath: "/staging/vol_1", opts: &volumeOptions{}, trimmedBytes: 8192}
+	d.registerVolume(vol)
+	d.recordTrimmedBytes(vol)
+	state, err := d.state.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8192), state.TrimmedBytes)
+
+	// e.g. moved to a larger device
+	expanded := &stagedVolume{volumeID: "vol_1", stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	d.registerVolume(expanded)
+	assert.Equal(t, uint64(8192), expanded.trimmedBytes)
+}
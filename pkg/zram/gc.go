@@ -0,0 +1,241 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// orphanedDevice is a zram device created by the driver that no staged volume uses.
+type orphanedDevice struct {
+	dev *ZRAMDevice
+	// label is the filesystem label that identifies the device as created by the driver
+	label string
+	// state is the record of the interrupted operation that left the device behind, nil if
+	// the device is only known by its label
+	state *volumeState
+}
+
+// key identifies an orphan across passes, so that a device removed and added again by
+// someone else is not mistaken for the same orphan.
+func (o *orphanedDevice) key() string {
+	if o.state != nil {
+		return o.dev.devPath + "/" + o.state.VolumeID
+	}
+	return o.dev.devPath + "/" + o.label
+}
+
+// deviceCollector removes the orphaned devices of the driver once they have been seen
+// orphaned for longer than the grace period.
+type deviceCollector struct {
+	gracePeriod time.Duration
+	dryRun      bool
+	// when each orphan was first found
+	firstSeen map[string]time.Time
+	mux       sync.Mutex
+}
+
+func newDeviceCollector(gracePeriod time.Duration, dryRun bool) *deviceCollector {
+	return &deviceCollector{
+		gracePeriod: gracePeriod,
+		dryRun:      dryRun,
+		firstSeen:   make(map[string]time.Time),
+	}
+}
+
+// due records the orphans found by a pass and returns the ones orphaned for at least the
+// grace period. Orphans no longer found are forgotten.
+func (gc *deviceCollector) due(orphans []*orphanedDevice, now time.Time) []*orphanedDevice {
+	gc.mux.Lock()
+	defer gc.mux.Unlock()
+	firstSeen := make(map[string]time.Time, len(orphans))
+	var due []*orphanedDevice
+	for _, orphan := range orphans {
+		since, ok := gc.firstSeen[orphan.key()]
+		if !ok {
+			since = now
+		}
+		firstSeen[orphan.key()] = since
+		if now.Sub(since) >= gc.gracePeriod {
+			due = append(due, orphan)
+		}
+	}
+	gc.firstSeen = firstSeen
+	return due
+}
+
+// findOrphanedDevices returns the devices left behind by interrupted operations whose
+// rollback failed, and the devices holding a filesystem labelled by the driver that are
+// neither mounted nor known as staged. Devices without a label or record, such as zram
+// swap, are never returned.
+func (d *Driver) findOrphanedDevices() ([]*orphanedDevice, error) {
+	states, err := d.state.List()
+	if err != nil {
+		return nil, err
+	}
+	devices, err := ListZRAMDevices()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int]bool)
+	for _, vol := range d.volumes.List() {
+		known[vol.dev.id] = true
+	}
+	var orphans []*orphanedDevice
+	for _, state := range states {
+		if state.DeviceID < 0 {
+			continue
+		}
+		if state.Phase != phaseStaged && !known[state.DeviceID] {
+			dev, _ := NewZRAMDeviceFromId(state.DeviceID)
+			if dev.Exists() {
+				orphans = append(orphans, &orphanedDevice{dev: dev, state: state})
+			}
+		}
+		known[state.DeviceID] = true
+		if state.Intent == intentExpand {
+			// the device the volume is being migrated to
+			known[state.expandDevice()] = true
+		}
+	}
+	for _, mp := range mountPoints {
+		if dev, err := NewZRAMDeviceFromDevPath(mp.Device); err == nil {
+			known[dev.id] = true
+		}
+	}
+
+	for _, dev := range devices {
+		if known[dev.id] {
+			continue
+		}
+		if diskSize, err := dev.GetDiskSize(); err != nil || diskSize == 0 {
+			continue
+		}
+		label, err := dev.GetFilesystemLabel()
+		if err != nil {
+			klog.Warningf("gc: failed to get filesystem label of %s: %v", dev.devPath, err)
+			continue
+		}
+		if isVolumeLabel(label) {
+			orphans = append(orphans, &orphanedDevice{dev: dev, label: label})
+		}
+	}
+	return orphans, nil
+}
+
+func containsOrphan(orphans []*orphanedDevice, orphan *orphanedDevice) bool {
+	for _, o := range orphans {
+		if o.key() == orphan.key() {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *orphanedDevice) String() string {
+	if o.state != nil {
+		return fmt.Sprintf("%s of volume %s interrupted at %q", o.dev.devPath, o.state.VolumeID, o.state.Intent)
+	}
+	return fmt.Sprintf("%s labelled %s", o.dev.devPath, o.label)
+}
+
+// collectOrphanedDevices resets and removes the orphaned devices found for longer than
+// the grace period.
+func (d *Driver) collectOrphanedDevices() {
+	orphans, err := d.findOrphanedDevices()
+	if err != nil {
+		klog.Errorf("gc: failed to find orphaned zram devices: %v", err)
+		return
+	}
+	for _, orphan := range d.gc.due(orphans, time.Now()) {
+		if d.gc.dryRun {
+			klog.Infof("gc: would remove orphaned device %s", orphan)
+			continue
+		}
+		removed, err := d.removeOrphanedDevice(orphan)
+		if err != nil {
+			klog.Errorf("gc: failed to remove orphaned device %s: %v", orphan, err)
+		} else if removed {
+			klog.Infof("gc: removed orphaned device %s", orphan)
+		}
+	}
+}
+
+// removeOrphanedDevice tears down the volume an orphan was recorded for, unless an operation
+// on the volume is in progress or its record changed. A device only known by its label is
+// reset and removed, unless an operation on the volume of the label is in progress or the
+// device was claimed since it was found. Resetting fails if the device is still open.
+func (d *Driver) removeOrphanedDevice(orphan *orphanedDevice) (bool, error) {
+	if orphan.state != nil {
+		volumeID := orphan.state.VolumeID
+		if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+			klog.V(2).Infof("gc: an operation on volume %s is in progress, skip %s", volumeID, orphan.dev.devPath)
+			return false, nil
+		}
+		defer d.volumeLocks.Release(volumeID)
+		state, err := d.state.Load(volumeID)
+		if err != nil {
+			return false, err
+		}
+		if state == nil || state.Phase == phaseStaged || state.DeviceID != orphan.dev.id {
+			return false, nil
+		}
+		if err := d.teardownVolume(state); err != nil {
+			return false, err
+		}
+		if state.Phase == phaseUnstaging {
+			return true, d.generations.Delete(volumeID)
+		}
+		return true, nil
+	}
+
+	if acquired := d.volumeLocks.TryAcquireLabel(orphan.label); !acquired {
+		klog.V(2).Infof("gc: an operation on the volume labelled %s is in progress, skip %s", orphan.label, orphan.dev.devPath)
+		return false, nil
+	}
+	defer d.volumeLocks.ReleaseLabel(orphan.label)
+	orphans, err := d.findOrphanedDevices()
+	if err != nil {
+		return false, err
+	}
+	if !containsOrphan(orphans, orphan) {
+		return false, nil
+	}
+	backingDev, err := orphan.dev.GetBackingDev()
+	if err != nil {
+		klog.Warningf("gc: failed to get backing device of %s: %v", orphan.dev.devPath, err)
+	}
+	if err := orphan.dev.Reset(); err != nil {
+		return false, err
+	}
+	if err := orphan.dev.Remove(); err != nil {
+		return false, err
+	}
+	if backingDev != "" {
+		return true, deleteBackingDev(backingDev)
+	}
+	return true, nil
+}
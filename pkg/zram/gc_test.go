@@ -0,0 +1,102 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceCollectorDue(t *testing.T) {
+	gc := newDeviceCollector(time.Minute, false)
+	dev0, _ := NewZRAMDeviceFromId(0)
+	dev1, _ := NewZRAMDeviceFromId(1)
+	labelled := &orphanedDevice{dev: dev0, label: "zc0123456789"}
+	recorded := &orphanedDevice{dev: dev1, state: newVolumeState("vol_1", "/staging/vol_1", nil, true)}
+	start := time.Now()
+
+	assert.Empty(t, gc.due([]*orphanedDevice{labelled, recorded}, start))
+	assert.Empty(t, gc.due([]*orphanedDevice{labelled, recorded}, start.Add(30*time.Second)))
+	// recorded is no longer orphaned and forgotten
+	assert.Equal(t, []*orphanedDevice{labelled}, gc.due([]*orphanedDevice{labelled}, start.Add(time.Minute)))
+	assert.Equal(t, []*orphanedDevice{labelled}, gc.due([]*orphanedDevice{labelled, recorded}, start.Add(90*time.Second)))
+
+	// the device was removed and added again with another filesystem
+	relabelled := &orphanedDevice{dev: dev0, label: "zc9876543210"}
+	assert.Empty(t, gc.due([]*orphanedDevice{relabelled}, start.Add(2*time.Minute)))
+	assert.Equal(t, []*orphanedDevice{relabelled}, gc.due([]*orphanedDevice{relabelled}, start.Add(3*time.Minute)))
+
+	gc = newDeviceCollector(0, false)
+	assert.Equal(t, []*orphanedDevice{labelled}, gc.due([]*orphanedDevice{labelled}, start))
+}
+
+func TestRemoveOrphanedDeviceSkipsBusyVolumes(t *testing.T) {
+	d := NewFakeDriver()
+	d.state = newStateStore(t.TempDir())
+	dev, _ := NewZRAMDeviceFromId(1000)
+
+	state := newVolumeState("vol_1", "/staging/vol_1", nil, false)
+	state.DeviceID = dev.id
+	assert.NoError(t, d.state.Save(state))
+	orphan := &orphanedDevice{dev: dev, state: state}
+
+	// an operation on the volume is in progress
+	assert.True(t, d.volumeLocks.TryAcquire("vol_1"))
+	removed, err := d.removeOrphanedDevice(orphan)
+	assert.NoError(t, err)
+	assert.False(t, removed)
+	d.volumeLocks.Release("vol_1")
+
+	// the volume was staged since the orphan was found
+	state.Phase = phaseStaged
+	assert.NoError(t, d.state.Save(state))
+	removed, err = d.removeOrphanedDevice(orphan)
+	assert.NoError(t, err)
+	assert.False(t, removed)
+
+	// the stage failed and its rollback is completed
+	state.Phase = phaseStaging
+	assert.NoError(t, d.state.Save(state))
+	removed, err = d.removeOrphanedDevice(orphan)
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	loaded, err := d.state.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func TestRemoveOrphanedDeviceSkipsBusyLabels(t *testing.T) {
+	d := NewFakeDriver()
+	dev, _ := NewZRAMDeviceFromId(1000)
+	orphan := &orphanedDevice{dev: dev, label: volumeLabel("vol_1")}
+
+	// the volume of the label is being staged
+	assert.True(t, d.volumeLocks.TryAcquire("vol_1"))
+	removed, err := d.removeOrphanedDevice(orphan)
+	assert.NoError(t, err)
+	assert.False(t, removed)
+	d.volumeLocks.Release("vol_1")
+
+	// the volume cannot be staged while its device is removed
+	assert.True(t, d.volumeLocks.TryAcquireLabel(orphan.label))
+	assert.False(t, d.volumeLocks.TryAcquire("vol_1"))
+	assert.True(t, d.volumeLocks.TryAcquire("vol_2"))
+	d.volumeLocks.ReleaseLabel(orphan.label)
+	assert.True(t, d.volumeLocks.TryAcquire("vol_1"))
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// bootIDPath holds a random ID generated on every boot of the node
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// volumeGeneration marks a volume as staged on the node. Unlike the zram device and the state
+// store, markers survive a reboot, so a marker found when a new device is about to be created
+// for the volume means that its data was lost.
+type volumeGeneration struct {
+	VolumeID string `json:"volumeID"`
+	// Generation counts the empty filesystems created for the volume since it was first staged
+	Generation int       `json:"generation"`
+	BootID     string    `json:"bootID"`
+	StagedAt   time.Time `json:"stagedAt"`
+}
+
+// generationStore keeps one marker per volume in a directory, markers are replaced atomically.
+// A store without directory does not record anything.
+type generationStore struct {
+	dir string
+}
+
+func newGenerationStore(dir string) *generationStore {
+	return &generationStore{dir: dir}
+}
+
+func (s *generationStore) path(volumeID string) string {
+	return filepath.Join(s.dir, url.PathEscape(volumeID)+".json")
+}
+
+func (s *generationStore) Save(gen *volumeGeneration) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(gen)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(gen.VolumeID), data)
+}
+
+// Load returns the marker of the volume, nil if there is none.
+func (s *generationStore) Load(volumeID string) (*volumeGeneration, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.path(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	gen := &volumeGeneration{}
+	if err := json.Unmarshal(data, gen); err != nil {
+		return nil, fmt.Errorf("invalid generation marker of volume %s: %v", volumeID, err)
+	}
+	return gen, nil
+}
+
+func (s *generationStore) Delete(volumeID string) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(volumeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readBootID() (string, error) {
+	data, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// nextGeneration is called before a new zram device is created for a volume and returns the
+// marker to record once it is staged. A marker left by a previous stage means that the volume
+// was not unstaged and its data is gone: depending on the dataLossPolicy of the volume, the
+// loss is logged or staging fails with FailedPrecondition.
+func (d *Driver) nextGeneration(volumeID string, opts *volumeOptions) (*volumeGeneration, error) {
+	prev, err := d.generations.Load(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get generation of volume %s: %v", volumeID, err)
+	}
+	bootID, err := readBootID()
+	if err != nil {
+		klog.Warningf("failed to get boot ID: %v", err)
+	}
+	next := &volumeGeneration{VolumeID: volumeID, Generation: 1, BootID: bootID}
+	if prev == nil {
+		return next, nil
+	}
+	next.Generation = prev.Generation + 1
+
+	cause := "its zram device was removed"
+	if prev.BootID != bootID {
+		cause = "the node rebooted"
+	}
+	if opts.dataLossPolicy == dataLossPolicyFail {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"data of volume %s staged at %s was lost as %s, refusing to stage it empty (%s %s); remove %s to accept the loss",
+			volumeID, prev.StagedAt.Format(time.RFC3339), cause, dataLossPolicyField, dataLossPolicyFail, d.generations.path(volumeID))
+	}
+	klog.Warningf("data of volume %s staged at %s was lost as %s, staging it with an empty filesystem (generation %d)",
+		volumeID, prev.StagedAt.Format(time.RFC3339), cause, next.Generation)
+	return next, nil
+}
+
+// recordGeneration records the marker of a volume that was just staged.
+func (d *Driver) recordGeneration(gen *volumeGeneration) error {
+	gen.StagedAt = time.Now().UTC()
+	if err := d.generations.Save(gen); err != nil {
+		return status.Errorf(codes.Internal, "failed to record generation of volume %s: %v", gen.VolumeID, err)
+	}
+	return nil
+}
+
+// ensureGeneration records a marker for a volume found staged without one, e.g. staged by a
+// version of the driver that did not record markers.
+func (d *Driver) ensureGeneration(volumeID string) {
+	if gen, err := d.generations.Load(volumeID); err != nil || gen != nil {
+		return
+	}
+	bootID, err := readBootID()
+	if err != nil {
+		klog.Warningf("failed to get boot ID: %v", err)
+	}
+	if err := d.recordGeneration(&volumeGeneration{VolumeID: volumeID, Generation: 1, BootID: bootID}); err != nil {
+		klog.Warningf("%v", err)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNextGeneration(t *testing.T) {
+	dir := t.TempDir()
+	origBootIDPath := bootIDPath
+	bootIDPath = filepath.Join(dir, "boot_id")
+	defer func() { bootIDPath = origBootIDPath }()
+	setBootID := func(id string) {
+		assert.NoError(t, ioutil.WriteFile(bootIDPath, []byte(id+"\n"), 0644))
+	}
+
+	d := NewFakeDriver()
+	d.generations = newGenerationStore(filepath.Join(dir, "generations"))
+	assert.NoError(t, os.MkdirAll(d.generations.dir, 0750))
+	setBootID("boot-1")
+
+	// first stage
+	gen, err := d.nextGeneration("vol_1", &volumeOptions{dataLossPolicy: dataLossPolicyFail})
+	assert.NoError(t, err)
+	assert.Equal(t, &volumeGeneration{VolumeID: "vol_1", Generation: 1, BootID: "boot-1"}, gen)
+	assert.NoError(t, d.recordGeneration(gen))
+
+	// staged again after a reboot
+	setBootID("boot-2")
+	_, err = d.nextGeneration("vol_1", &volumeOptions{dataLossPolicy: dataLossPolicyFail})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "the node rebooted")
+
+	gen, err = d.nextGeneration("vol_1", &volumeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, gen.Generation)
+	assert.Equal(t, "boot-2", gen.BootID)
+	assert.NoError(t, d.recordGeneration(gen))
+
+	// staged again in the same boot
+	_, err = d.nextGeneration("vol_1", &volumeOptions{dataLossPolicy: dataLossPolicyFail})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "its zram device was removed")
+
+	// unstaged volumes start over
+	assert.NoError(t, d.generations.Delete("vol_1"))
+	gen, err = d.nextGeneration("vol_1", &volumeOptions{dataLossPolicy: dataLossPolicyFail})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, gen.Generation)
+}
+
+func TestEnsureGeneration(t *testing.T) {
+	d := NewFakeDriver()
+	d.generations = newGenerationStore(t.TempDir())
+
+	d.ensureGeneration("vol_1")
+	gen, err := d.generations.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, gen.Generation)
+
+	gen.Generation = 3
+	assert.NoError(t, d.generations.Save(gen))
+	d.ensureGeneration("vol_1")
+	gen, err = d.generations.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, gen.Generation)
+}
+
+func TestDeleteVolumeGeneration(t *testing.T) {
+	d := NewFakeDriver()
+	d.generations = newGenerationStore(t.TempDir())
+	d.ensureGeneration("vol_1")
+
+	_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol_1"})
+	assert.NoError(t, err)
+	gen, err := d.generations.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Nil(t, gen)
+
+	// retried, or never staged
+	_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol_1"})
+	assert.NoError(t, err)
+}
@@ -60,6 +60,13 @@ func (f *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 				},
 			},
 		},
+		{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_OFFLINE,
+				},
+			},
+		},
 	}
 	if f.enableTopology {
 		caps = append(caps, &csi.PluginCapability{
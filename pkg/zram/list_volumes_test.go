@@ -0,0 +1,99 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func newListVolumesDriver(t *testing.T) *Driver {
+	d := NewFakeDriver()
+	d.state = newStateStore(t.TempDir())
+	for i := 1; i <= 3; i++ {
+		dev := newFakeZRAMDevice(t, map[string]string{"disksize": fmt.Sprintf("%d\n", i*1048576)})
+		dev.id = i
+		dev.devPath = fmt.Sprintf("/dev/zram%d", i)
+		d.volumes.Add(&stagedVolume{volumeID: fmt.Sprintf("vol_%d", i), dev: dev, stagingPath: fmt.Sprintf("/staging/vol_%d", i), opts: &volumeOptions{}})
+	}
+	state := newVolumeState("vol_1", "/staging/vol_1", map[string]string{capacityField: "1048576", compAlgorithmField: "zstd"}, false)
+	state.Phase = phaseStaged
+	assert.NoError(t, d.state.Save(state))
+
+	vol, _ := d.volumes.Get("vol_2")
+	vol.addTarget("/publish/pod_1", false)
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/zram2", Path: "/staging/vol_2"},
+		{Device: "/dev/zram2", Path: "/publish/pod_2"},
+	})}
+	return d
+}
+
+func TestListVolumes(t *testing.T) {
+	d := newListVolumesDriver(t)
+
+	resp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 2)
+	assert.Equal(t, "2", resp.NextToken)
+
+	vol1 := resp.Entries[0]
+	assert.Equal(t, "vol_1", vol1.Volume.VolumeId)
+	assert.Equal(t, int64(1048576), vol1.Volume.CapacityBytes)
+	assert.Equal(t, map[string]string{capacityField: "1048576", compAlgorithmField: "zstd"}, vol1.Volume.VolumeContext)
+	assert.Empty(t, vol1.Status.PublishedNodeIds)
+	assert.NotNil(t, vol1.Status.VolumeCondition)
+
+	vol2 := resp.Entries[1]
+	assert.Equal(t, "vol_2", vol2.Volume.VolumeId)
+	assert.Equal(t, int64(2097152), vol2.Volume.CapacityBytes)
+	assert.Equal(t, "/publish/pod_1,/publish/pod_2", vol2.Volume.VolumeContext[publishTargetsField])
+	assert.Equal(t, []string{fakeNodeID}, vol2.Status.PublishedNodeIds)
+
+	resp, err = d.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: resp.NextToken})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 1)
+	assert.Equal(t, "vol_3", resp.Entries[0].Volume.VolumeId)
+	assert.Empty(t, resp.NextToken)
+
+	for _, token := range []string{"4", "-1", "vol_1"} {
+		_, err = d.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: token})
+		assert.Equal(t, codes.Aborted, status.Code(err), token)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	d := newListVolumesDriver(t)
+
+	resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol_2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "vol_2", resp.Volume.VolumeId)
+	assert.Equal(t, []string{fakeNodeID}, resp.Status.PublishedNodeIds)
+	assert.NotNil(t, resp.Status.VolumeCondition)
+
+	_, err = d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol_4"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "zram_csi"
+
+var (
+	volumeLabels = []string{"volume_id", "device"}
+
+	volumeDiskSizeDesc = prometheus.NewDesc(metricsNamespace+"_volume_disk_size_bytes",
+		"Logical size of the zram device.", volumeLabels, nil)
+	volumeOrigDataDesc = prometheus.NewDesc(metricsNamespace+"_volume_orig_data_bytes",
+		"Uncompressed size of the data stored in the zram device.", volumeLabels, nil)
+	volumeComprDataDesc = prometheus.NewDesc(metricsNamespace+"_volume_compr_data_bytes",
+		"Compressed size of the data stored in the zram device.", volumeLabels, nil)
+	volumeMemUsedDesc = prometheus.NewDesc(metricsNamespace+"_volume_mem_used_bytes",
+		"Memory allocated by the zram device, including fragmentation and metadata.", volumeLabels, nil)
+	volumeMemLimitDesc = prometheus.NewDesc(metricsNamespace+"_volume_mem_limit_bytes",
+		"Memory limit of the zram device, 0 if unlimited.", volumeLabels, nil)
+	volumeHugePagesDesc = prometheus.NewDesc(metricsNamespace+"_volume_huge_pages",
+		"Number of incompressible pages stored in the zram device.", volumeLabels, nil)
+	volumeFailedReadsDesc = prometheus.NewDesc(metricsNamespace+"_volume_failed_reads_total",
+		"Number of failed reads of the zram device.", volumeLabels, nil)
+	volumeFailedWritesDesc = prometheus.NewDesc(metricsNamespace+"_volume_failed_writes_total",
+		"Number of failed writes of the zram device, e.g. because the memory limit was reached.", volumeLabels, nil)
+	volumeTrimmedDesc = prometheus.NewDesc(metricsNamespace+"_volume_trimmed_bytes_total",
+		"Number of bytes discarded by the periodic fstrim of the volume since it was staged.", volumeLabels, nil)
+
+	nodeVolumesDesc = prometheus.NewDesc(metricsNamespace+"_node_volumes",
+		"Number of zram volumes staged on the node.", nil, nil)
+	nodeDiskSizeDesc = prometheus.NewDesc(metricsNamespace+"_node_disk_size_bytes",
+		"Total logical size of the zram devices managed by the driver.", nil, nil)
+	nodeOrigDataDesc = prometheus.NewDesc(metricsNamespace+"_node_orig_data_bytes",
+		"Total uncompressed size of the data stored in the zram devices managed by the driver.", nil, nil)
+	nodeComprDataDesc = prometheus.NewDesc(metricsNamespace+"_node_compr_data_bytes",
+		"Total compressed size of the data stored in the zram devices managed by the driver.", nil, nil)
+	nodeMemUsedDesc = prometheus.NewDesc(metricsNamespace+"_node_mem_used_bytes",
+		"Total memory allocated by the zram devices managed by the driver.", nil, nil)
+)
+
+// volumeCollector reports the usage of the staged zram volumes on each scrape.
+type volumeCollector struct {
+	volumes *volumeRegistry
+}
+
+// Describe implements prometheus.Collector.
+func (c *volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		volumeDiskSizeDesc, volumeOrigDataDesc, volumeComprDataDesc, volumeMemUsedDesc,
+		volumeMemLimitDesc, volumeHugePagesDesc, volumeFailedReadsDesc, volumeFailedWritesDesc,
+		volumeTrimmedDesc,
+		nodeVolumesDesc, nodeDiskSizeDesc, nodeOrigDataDesc, nodeComprDataDesc, nodeMemUsedDesc,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	var volumes, diskSizeTotal, origDataTotal, comprDataTotal, memUsedTotal float64
+	for _, vol := range c.volumes.List() {
+		labels := []string{vol.volumeID, "zram" + strconv.Itoa(vol.dev.GetId())}
+		diskSize, err := vol.dev.GetDiskSize()
+		if err != nil {
+			klog.Warningf("metrics: failed to get disksize of %s: %v", vol.dev.devPath, err)
+			continue
+		}
+		mmStat, err := vol.dev.MMStat()
+		if err != nil {
+			klog.Warningf("metrics: failed to get memory statistics of %s: %v", vol.dev.devPath, err)
+			continue
+		}
+		volumes++
+		diskSizeTotal += float64(diskSize)
+		origDataTotal += float64(mmStat.OrigDataSize)
+		comprDataTotal += float64(mmStat.ComprDataSize)
+		memUsedTotal += float64(mmStat.MemUsedTotal)
+
+		ch <- prometheus.MustNewConstMetric(volumeDiskSizeDesc, prometheus.GaugeValue, float64(diskSize), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeOrigDataDesc, prometheus.GaugeValue, float64(mmStat.OrigDataSize), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeComprDataDesc, prometheus.GaugeValue, float64(mmStat.ComprDataSize), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeMemUsedDesc, prometheus.GaugeValue, float64(mmStat.MemUsedTotal), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeMemLimitDesc, prometheus.GaugeValue, float64(mmStat.MemLimit), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeHugePagesDesc, prometheus.GaugeValue, float64(mmStat.HugePages), labels...)
+		if vol.opts.discardMode == discardModeFstrim {
+			ch <- prometheus.MustNewConstMetric(volumeTrimmedDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&vol.trimmedBytes)), labels...)
+		}
+
+		ioStat, err := vol.dev.IOStat()
+		if err != nil {
+			klog.Warningf("metrics: failed to get I/O statistics of %s: %v", vol.dev.devPath, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(volumeFailedReadsDesc, prometheus.CounterValue, float64(ioStat.FailedReads), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeFailedWritesDesc, prometheus.CounterValue, float64(ioStat.FailedWrites), labels...)
+	}
+	ch <- prometheus.MustNewConstMetric(nodeVolumesDesc, prometheus.GaugeValue, volumes)
+	ch <- prometheus.MustNewConstMetric(nodeDiskSizeDesc, prometheus.GaugeValue, diskSizeTotal)
+	ch <- prometheus.MustNewConstMetric(nodeOrigDataDesc, prometheus.GaugeValue, origDataTotal)
+	ch <- prometheus.MustNewConstMetric(nodeComprDataDesc, prometheus.GaugeValue, comprDataTotal)
+	ch <- prometheus.MustNewConstMetric(nodeMemUsedDesc, prometheus.GaugeValue, memUsedTotal)
+}
+
+// serveMetrics serves the Prometheus metrics of the driver on address until the process exits.
+func (d *Driver) serveMetrics(address string) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&volumeCollector{volumes: d.volumes})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	klog.V(2).Infof("serving metrics on %s", address)
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			klog.Errorf("metrics server on %s failed: %v", address, err)
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVolumeCollector(t *testing.T) {
+	volumes := newVolumeRegistry()
+	dev := newFakeZRAMDevice(t, map[string]string{
+		"disksize": "1073741824\n",
+		"mm_stat":  "8192 4096 12288 10485760 16384 0 0 1\n",
+		"io_stat":  "0 5 0 0\n",
+	})
+	dev.id = 3
+	volumes.Add(&stagedVolume{volumeID: "vol_1", dev: dev, opts: &volumeOptions{discardMode: discardModeFstrim}, trimmedBytes: 65536})
+
+	expected := `
+# HELP zram_csi_node_mem_used_bytes Total memory allocated by the zram devices managed by the driver.
+# TYPE zram_csi_node_mem_used_bytes gauge
+zram_csi_node_mem_used_bytes 12288
+# HELP zram_csi_node_volumes Number of zram volumes staged on the node.
+# TYPE zram_csi_node_volumes gauge
+zram_csi_node_volumes 1
+# HELP zram_csi_volume_compr_data_bytes Compressed size of the data stored in the zram device.
+# TYPE zram_csi_volume_compr_data_bytes gauge
+zram_csi_volume_compr_data_bytes{device="zram3",volume_id="vol_1"} 4096
+# HELP zram_csi_volume_disk_size_bytes Logical size of the zram device.
+# TYPE zram_csi_volume_disk_size_bytes gauge
+zram_csi_volume_disk_size_bytes{device="zram3",volume_id="vol_1"} 1.073741824e+09
+# HELP zram_csi_volume_failed_writes_total Number of failed writes of the zram device, e.g. because the memory limit was reached.
+# TYPE zram_csi_volume_failed_writes_total counter
+zram_csi_volume_failed_writes_total{device="zram3",volume_id="vol_1"} 5
+# HELP zram_csi_volume_mem_limit_bytes Memory limit of the zram device, 0 if unlimited.
+# TYPE zram_csi_volume_mem_limit_bytes gauge
+zram_csi_volume_mem_limit_bytes{device="zram3",volume_id="vol_1"} 1.048576e+07
+# HELP zram_csi_volume_trimmed_bytes_total Number of bytes discarded by the periodic fstrim of the volume since it was staged.
+# TYPE zram_csi_volume_trimmed_bytes_total counter
+zram_csi_volume_trimmed_bytes_total{device="zram3",volume_id="vol_1"} 65536
+`
+	err := testutil.CollectAndCompare(&volumeCollector{volumes: volumes}, strings.NewReader(expected),
+		"zram_csi_node_mem_used_bytes", "zram_csi_node_volumes", "zram_csi_volume_compr_data_bytes",
+		"zram_csi_volume_disk_size_bytes", "zram_csi_volume_failed_writes_total", "zram_csi_volume_mem_limit_bytes",
+		"zram_csi_volume_trimmed_bytes_total")
+	if err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
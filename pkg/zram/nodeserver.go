@@ -57,12 +57,30 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		mountOptions = append(mountOptions, "ro")
 	}
 
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		if err := d.publishBlockVolume(volumeID, source, target, mountOptions); err != nil {
+			return nil, err
+		}
+		if err := d.recordPublishTarget(volumeID, target, req.GetReadonly(), true); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	mnt, err := d.ensureMountPoint(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not mount target %q: %v", target, err)
 	}
 	if mnt {
 		klog.V(2).Infof("NodePublishVolume: %s is already mounted", target)
+		if err := d.recordPublishTarget(volumeID, target, req.GetReadonly(), true); err != nil {
+			return nil, err
+		}
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
@@ -78,6 +96,9 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Errorf(codes.Internal, "Could not mount %q at %q: %v", source, target, err)
 	}
 	klog.V(2).Infof("NodePublishVolume: mount %s at %s volumeID(%s) successfully", source, target, volumeID)
+	if err := d.recordPublishTarget(volumeID, target, req.GetReadonly(), true); err != nil {
+		return nil, err
+	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -92,11 +113,19 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
 	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
 	err := Unmount(d.mounter, targetPath, true /*extensiveMountPointCheck*/)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
 	}
+	if err := d.recordPublishTarget(volumeID, targetPath, false, false); err != nil {
+		return nil, err
+	}
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -120,13 +149,17 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 
 	context := req.GetVolumeContext()
 	mountFlags := volumeCapability.GetMount().GetMountFlags()
-	fsType := volumeCapability.GetMount().FsType
+	fsType := volumeCapability.GetMount().GetFsType()
 
 	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
 	}
 	defer d.volumeLocks.Release(volumeID)
 
+	context, err := d.stagingContext(volumeID, context)
+	if err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(targetPath, 0750); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("MkdirAll %s failed with error: %v", targetPath, err))
 	}
@@ -134,47 +167,345 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	klog.V(2).Infof("NodeStageVolume: targetPath(%v) volumeID(%v) context(%v) mountflags(%v)",
 		targetPath, volumeID, context, mountFlags)
 
+	opts, err := parseVolumeOptions(context)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid volume context: %v", err)
+	}
+	if volumeCapability.GetBlock() != nil {
+		if err := d.stageBlockVolume(volumeID, targetPath, context, opts); err != nil {
+			return nil, err
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if opts.discardMode == discardModeOnline {
+		mountFlags = append(mountFlags, "discard")
+	}
 	isDirMounted, err := d.ensureMountPoint(targetPath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not mount target %s: %v", targetPath, err)
 	}
 	if isDirMounted {
 		klog.V(2).Infof("NodeStageVolume: already mounted volume %s on target %s", volumeID, targetPath)
-	} else {
-		var capacity int64
-		strCapacity, ok := context[capacityField]
-		if !ok {
-			return nil, status.Errorf(codes.Internal, "Expected capacity field in volume context")
+		if _, ok := d.volumes.Get(volumeID); !ok {
+			if dev, err := NewZRAMDeviceFromMountPath(targetPath); err == nil {
+				d.ensureStagedState(volumeID, targetPath, context, dev, false)
+				capacity, _ := volumeCapacity(context)
+				d.registerVolume(&stagedVolume{volumeID: volumeID, dev: dev, stagingPath: targetPath, opts: opts, capacity: capacity,
+					mountOptions: mountFlags})
+			}
 		}
-		capacity, err = strconv.ParseInt(strCapacity, 10, 64)
+	} else {
+		capacity, err := volumeCapacity(context)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "Invalid zram capacity found in volume context: %s", strCapacity)
+			return nil, err
 		}
-		dev, err := NewZRAMDevice()
+		source, err := d.volumeContentSource(volumeID, context, capacity, false)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "Failed to create zram device: %v", err)
+			return nil, err
 		}
-		err = dev.Reset()
+		gen, err := d.nextGeneration(volumeID, opts)
 		if err != nil {
-			dev.Remove()
-			return nil, status.Errorf(codes.Internal, "Failed to reset zram device %s: %v", dev.devPath, err)
+			return nil, err
 		}
-		err = dev.SetDiskSize(capacity)
+		state := newVolumeState(volumeID, targetPath, context, false)
+		state.MountOptions = mountFlags
+		dev, err := d.createVolumeDevice(state, capacity, opts)
 		if err != nil {
-			dev.Remove()
-			return nil, status.Errorf(codes.Internal, "Failed to set zram device %s capacity %d: %v", dev.devPath, capacity, err)
+			return nil, err
+		}
+		if source != nil && source.volume != nil {
+			// a clone is a copy of the device of its source and keeps the filesystem of the source
+			if fsType, err = d.cloneVolume(state, dev, source.volume); err != nil {
+				d.abortStage(state)
+				return nil, err
+			}
+		}
+		if err := d.state.SetIntent(state, intentMount); err != nil {
+			d.abortStage(state)
+			return nil, status.Errorf(codes.Internal, "failed to record state of volume %s: %v", volumeID, err)
 		}
-		dev.FormatAndMount(targetPath, fsType, mountFlags)
+		err = dev.FormatAndMount(targetPath, fsType, volumeLabel(volumeID), mountFlags)
 		if err != nil {
-			dev.Remove()
+			d.abortStage(state)
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Volume(%s) mount %q on %q failed with %v", volumeID, dev.GetDevPath(), targetPath, err))
 		}
+		if source != nil && source.snapshot != nil {
+			if err := d.restoreSnapshot(state, dev, source.snapshot); err != nil {
+				d.abortStage(state)
+				return nil, err
+			}
+		}
+		if source != nil && source.volume != nil {
+			if err := d.growClone(state, dev); err != nil {
+				d.abortStage(state)
+				return nil, err
+			}
+		}
+		if err := d.completeStage(state, gen); err != nil {
+			return nil, err
+		}
+		if source != nil {
+			d.recordPopulated(volumeID)
+		}
 		klog.V(2).Infof("volume(%s) mount %q on %q succeeded", volumeID, dev.GetDevPath(), targetPath)
+		d.registerVolume(&stagedVolume{volumeID: volumeID, dev: dev, stagingPath: targetPath, opts: opts, capacity: capacity,
+			mountOptions: mountFlags})
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// createVolumeDevice reserves the budget of a volume, then adds and configures its zram device.
+// Each step is recorded in the state store first, so that it can be rolled back after a crash.
+// The device is removed and the volume forgotten on failure.
+func (d *Driver) createVolumeDevice(state *volumeState, capacity int64, opts *volumeOptions) (*ZRAMDevice, error) {
+	if err := d.budget.Reserve(state.StagingPath, capacity); err != nil {
+		return nil, status.Errorf(codes.ResourceExhausted, "Volume(%s): %v", state.VolumeID, err)
+	}
+	if err := d.state.SetIntent(state, intentHotAdd); err != nil {
+		d.abortStage(state)
+		return nil, status.Errorf(codes.Internal, "failed to record state of volume %s: %v", state.VolumeID, err)
+	}
+	dev, err := NewZRAMDevice()
+	if err != nil {
+		d.abortStage(state)
+		return nil, status.Errorf(codes.Internal, "Failed to create zram device: %v", err)
+	}
+	state.DeviceID = dev.id
+	if err := d.state.SetIntent(state, intentConfigure); err != nil {
+		d.abortStage(state)
+		return nil, status.Errorf(codes.Internal, "failed to record state of volume %s: %v", state.VolumeID, err)
+	}
+	if err := d.configureZRAMDevice(dev, state.VolumeID, state.VolumeID, capacity, opts); err != nil {
+		d.abortStage(state)
+		return nil, err
+	}
+	return dev, nil
+}
+
+// completeStage records a volume as staged together with its generation marker, the volume is
+// torn down if that fails so that it is never left in the store as an interrupted stage.
+func (d *Driver) completeStage(state *volumeState, gen *volumeGeneration) error {
+	state.Phase = phaseStaged
+	if err := d.state.SetIntent(state, ""); err != nil {
+		d.abortStage(state)
+		return status.Errorf(codes.Internal, "failed to record state of volume %s: %v", state.VolumeID, err)
+	}
+	if err := d.recordGeneration(gen); err != nil {
+		d.abortStage(state)
+		return err
+	}
+	return nil
+}
+
+// unstagingState returns the record of a volume about to be unstaged.
+func (d *Driver) unstagingState(volumeID, stagingPath string, dev *ZRAMDevice, block bool) (*volumeState, error) {
+	state, err := d.state.Load(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = newVolumeState(volumeID, stagingPath, nil, block)
+	}
+	state.DeviceID = dev.id
+	state.StagingPath = stagingPath
+	state.Block = block
+	state.Phase = phaseUnstaging
+	return state, nil
+}
+
+// abortStage tears down a volume that failed to stage.
+func (d *Driver) abortStage(state *volumeState) {
+	if err := d.teardownVolume(state); err != nil {
+		klog.Errorf("failed to roll back staging of volume %s: %v", state.VolumeID, err)
+	}
+}
+
+// ensureStagedState records a volume found staged without record, e.g. staged by an older version.
+func (d *Driver) ensureStagedState(volumeID, stagingPath string, parameters map[string]string, dev *ZRAMDevice, block bool) {
+	if state, err := d.state.Load(volumeID); err != nil || state != nil {
+		return
+	}
+	state := newVolumeState(volumeID, stagingPath, parameters, block)
+	state.DeviceID = dev.id
+	state.Phase = phaseStaged
+	if err := d.state.Save(state); err != nil {
+		klog.Warningf("failed to record state of volume %s: %v", volumeID, err)
+	}
+}
+
+// recordPublishTarget adds or removes a path the volume is published on, in the registry and
+// in the state store, so that the reconciler can restore lost bind mounts.
+func (d *Driver) recordPublishTarget(volumeID, target string, readOnly, published bool) error {
+	if vol, ok := d.volumes.Get(volumeID); ok {
+		if published {
+			vol.addTarget(target, readOnly)
+		} else {
+			vol.removeTarget(target)
+		}
+	}
+	state, err := d.state.Load(volumeID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get state of volume %s: %v", volumeID, err)
+	}
+	if state == nil {
+		return nil
+	}
+	if published {
+		if state.PublishTargets == nil {
+			state.PublishTargets = make(map[string]bool)
+		}
+		state.PublishTargets[target] = readOnly
+	} else {
+		delete(state.PublishTargets, target)
+	}
+	if err := d.state.Save(state); err != nil {
+		return status.Errorf(codes.Internal, "failed to record state of volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// teardownVolume unmounts and removes the zram device of a volume if it still exists, then
+// releases its budget and forgets the device in the inventory and the state store.
+func (d *Driver) teardownVolume(state *volumeState) error {
+	if state.DeviceID >= 0 {
+		dev, _ := NewZRAMDeviceFromId(state.DeviceID)
+		if dev.Exists() {
+			if !state.Block {
+				if err := d.state.SetIntent(state, intentUnmount); err != nil {
+					return err
+				}
+				if err := dev.UnmountAndCleanup(); err != nil {
+					return fmt.Errorf("failed to unmount %s: %v", dev.devPath, err)
+				}
+			}
+			if err := d.state.SetIntent(state, intentHotRemove); err != nil {
+				return err
+			}
+			if err := releaseZRAMDevice(dev); err != nil {
+				return fmt.Errorf("failed to remove device %s: %v", dev.devPath, err)
+			}
+		}
+	}
+	if state.Block {
+		if err := os.Remove(filepath.Join(state.StagingPath, blockDeviceFile)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	d.budget.Release(state.StagingPath)
+	d.inventory.Remove(volumeLabel(state.VolumeID))
+	return d.state.Delete(state.VolumeID)
+}
+
+// volumeCapacity returns the capacity the controller stored in the volume context.
+func volumeCapacity(context map[string]string) (int64, error) {
+	strCapacity, ok := context[capacityField]
+	if !ok {
+		return 0, status.Errorf(codes.Internal, "Expected capacity field in volume context")
+	}
+	capacity, err := strconv.ParseInt(strCapacity, 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal, "Invalid zram capacity found in volume context: %s", strCapacity)
+	}
+	return capacity, nil
+}
+
+// configureZRAMDevice resets a newly added zram device and applies the volume options.
+// Attributes that the kernel only accepts on an uninitialized device are written before disksize.
+// The backing file, if any, is named after backingName.
+func (d *Driver) configureZRAMDevice(dev *ZRAMDevice, volumeID, backingName string, capacity int64, opts *volumeOptions) error {
+	if err := dev.Reset(); err != nil {
+		return status.Errorf(codes.Internal, "Failed to reset zram device %s: %v", dev.devPath, err)
+	}
+	if compAlgorithms := opts.compAlgorithms(); len(compAlgorithms) > 0 {
+		algorithms, _, err := dev.GetCompAlgorithms()
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed to get compression algorithms of zram device %s: %v", dev.devPath, err)
+		}
+		for _, algorithm := range compAlgorithms {
+			if err := validateCompAlgorithm(algorithm, algorithms); err != nil {
+				return status.Error(codes.FailedPrecondition, err.Error())
+			}
+		}
+	}
+	if opts.compAlgorithm != "" {
+		if err := dev.SetCompAlgorithm(opts.compAlgorithm); err != nil {
+			return status.Errorf(codes.Internal, "Failed to set zram device %s compression algorithm %s: %v", dev.devPath, opts.compAlgorithm, err)
+		}
+	}
+	if opts.hasAlgorithmParams() {
+		if !dev.HasAttribute("algorithm_params") {
+			return status.Errorf(codes.FailedPrecondition, "zram device %s does not support compression level and dictionary, the kernel lacks algorithm_params", dev.devPath)
+		}
+		dictionary := ""
+		if opts.compDictionary != "" {
+			dictionary = filepath.Join(d.dictionaryDir, opts.compDictionary)
+			if _, err := os.Stat(dictionary); err != nil {
+				return status.Errorf(codes.FailedPrecondition, "compression dictionary %s is not available on node %s: %v", opts.compDictionary, d.NodeID, err)
+			}
+		}
+		if err := dev.SetAlgorithmParams(0, opts.compLevel, dictionary); err != nil {
+			return status.Errorf(codes.Internal, "Failed to set zram device %s algorithm parameters: %v", dev.devPath, err)
+		}
+	}
+	if len(opts.recompAlgorithms) > 0 && !dev.HasAttribute("recomp_algorithm") {
+		return status.Errorf(codes.FailedPrecondition, "zram device %s does not support recompression, the kernel lacks CONFIG_ZRAM_MULTI_COMP", dev.devPath)
+	}
+	for i, algorithm := range opts.recompAlgorithms {
+		if err := dev.SetRecompAlgorithm(algorithm, i+1); err != nil {
+			return status.Errorf(codes.Internal, "Failed to set zram device %s secondary compression algorithm %s: %v", dev.devPath, algorithm, err)
+		}
+	}
+	if opts.backingDir != "" {
+		if err := d.validateBackingDir(opts.backingDir); err != nil {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		backingSize := opts.backingSize
+		if backingSize == 0 {
+			backingSize = capacity
+		}
+		backingFile := backingFilePath(opts.backingDir, backingName)
+		if err := d.reclaimBackingFile(volumeID, backingFile); err != nil {
+			return status.Errorf(codes.Internal, "Failed to create backing device for zram device %s: %v", dev.devPath, err)
+		}
+		loopDev, err := createBackingDev(backingFile, backingSize)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed to create backing device for zram device %s: %v", dev.devPath, err)
+		}
+		if err := dev.SetBackingDev(loopDev); err != nil {
+			if detachErr := deleteBackingDev(loopDev); detachErr != nil {
+				klog.Errorf("failed to delete backing device %s: %v", loopDev, detachErr)
+			}
+			return status.Errorf(codes.Internal, "Failed to set zram device %s backing device %s: %v", dev.devPath, loopDev, err)
+		}
+	}
+	if err := dev.SetDiskSize(capacity); err != nil {
+		return status.Errorf(codes.Internal, "Failed to set zram device %s capacity %d: %v", dev.devPath, capacity, err)
+	}
+	if memLimit := opts.memLimitBytes(capacity); memLimit > 0 {
+		if err := dev.SetMemLimit(memLimit); err != nil {
+			return status.Errorf(codes.Internal, "Failed to set zram device %s memory limit %d: %v", dev.devPath, memLimit, err)
+		}
+	}
+	return nil
+}
+
+// releaseZRAMDevice removes the zram device together with its backing device, if any.
+func releaseZRAMDevice(dev *ZRAMDevice) error {
+	backingDev, err := dev.GetBackingDev()
+	if err != nil {
+		klog.Warningf("failed to get backing device of %s: %v", dev.devPath, err)
+	}
+	if err := dev.Remove(); err != nil {
+		return err
+	}
+	if backingDev != "" {
+		return deleteBackingDev(backingDev)
+	}
+	return nil
+}
+
 // NodeUnstageVolume unmount the volume from the staging path
 func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
@@ -191,19 +522,58 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	klog.V(2).Infof("NodeUnstageVolume: CleanupMountPoint on %s with volume %s", stagingTargetPath, volumeID)
-	dev, err := NewZRAMDeviceFromMountPath(stagingTargetPath)
+	d.volumeTasks.Stop(volumeID)
+
+	blockDev, err := d.stagedBlockDevice(volumeID, stagingTargetPath)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get zram device mounted at staging target %s: %v", stagingTargetPath, err)
+		return nil, status.Errorf(codes.Internal, "failed to get zram device of staging target %s: %v", stagingTargetPath, err)
 	}
-	err = dev.UnmountAndCleanup()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %s: %v", stagingTargetPath, err)
+	if blockDev != nil {
+		klog.V(2).Infof("NodeUnstageVolume: removing device %s of block volume %s", blockDev.devPath, volumeID)
+		state, err := d.unstagingState(volumeID, stagingTargetPath, blockDev, true)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get state of volume %s: %v", volumeID, err)
+		}
+		if err := d.teardownVolume(state); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unstage block volume %s: %v", volumeID, err)
+		}
+		if err := d.generations.Delete(volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete generation of volume %s: %v", volumeID, err)
+		}
+		d.volumes.Remove(volumeID)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	klog.V(2).Infof("NodeUnstageVolume: CleanupMountPoint on %s with volume %s", stagingTargetPath, volumeID)
+	dev := d.findVolumeDevice(volumeID, stagingTargetPath)
+	if dev == nil {
+		// already removed, or never created, only make sure nothing is left behind
+		klog.V(2).Infof("NodeUnstageVolume: no zram device found for volume %s", volumeID)
+		if err := Unmount(d.mounter, stagingTargetPath, true /*extensiveMountPointCheck*/); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount staging target %s: %v", stagingTargetPath, err)
+		}
+		if err := d.state.Delete(volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete state of volume %s: %v", volumeID, err)
+		}
+		if err := d.generations.Delete(volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to delete generation of volume %s: %v", volumeID, err)
+		}
+		d.budget.Release(stagingTargetPath)
+		d.inventory.Remove(volumeLabel(volumeID))
+		d.volumes.Remove(volumeID)
+		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
-	err = dev.Remove()
+	state, err := d.unstagingState(volumeID, stagingTargetPath, dev, false)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to remove device %s: %v", dev.devPath, err)
+		return nil, status.Errorf(codes.Internal, "failed to get state of volume %s: %v", volumeID, err)
+	}
+	if err := d.teardownVolume(state); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unstage volume %s from %s: %v", volumeID, stagingTargetPath, err)
 	}
+	if err := d.generations.Delete(volumeID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete generation of volume %s: %v", volumeID, err)
+	}
+	d.volumes.Remove(volumeID)
 
 	klog.V(2).Infof("NodeUnstageVolume: unmount volume %s on %s successfully", volumeID, stagingTargetPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
@@ -238,19 +608,28 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty")
 	}
 
-	if _, err := os.Lstat(req.VolumePath); err != nil {
+	fi, err := os.Stat(req.VolumePath)
+	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "path %s does not exist", req.VolumePath)
 		}
 		return nil, status.Errorf(codes.Internal, "failed to stat path %s: %v", req.VolumePath, err)
 	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		resp, err := blockVolumeStats(req.VolumePath)
+		if err != nil {
+			return nil, err
+		}
+		resp.VolumeCondition = d.volumeCondition(req.VolumeId, req.VolumePath, req.StagingTargetPath, true)
+		return resp, nil
+	}
 
 	available, capacity, usage, inodes, inodesFree, inodesUsed, err := fs.Info(req.VolumePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to statfs path %s: %v", req.VolumePath, err)
 	}
 
-	return &csi.NodeGetVolumeStatsResponse{
+	resp := &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
 				Unit:      csi.VolumeUsage_BYTES,
@@ -265,13 +644,83 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 				Used:      inodesUsed,
 			},
 		},
+	}
+
+	resp.VolumeCondition = d.volumeCondition(req.VolumeId, req.VolumePath, req.StagingTargetPath, false)
+	return resp, nil
+}
+
+// blockVolumeStats reports the size of the zram device of a raw block volume published at volumePath.
+func blockVolumeStats(volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	dev, err := NewZRAMDeviceFromDeviceFile(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get zram device of %s: %v", volumePath, err)
+	}
+	diskSize, err := dev.GetDiskSize()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get size of %s: %v", dev.devPath, err)
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: diskSize,
+			},
+		},
 	}, nil
 }
 
-// NodeExpandVolume node expand volume
-// N/A for zram
+// NodeExpandVolume moves a staged volume to a larger zram device. Only volumes that are not
+// published can be expanded, as running pods would keep files open on the previous device.
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	if capacity <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Required capacity missing in request")
+	}
+
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	vol, ok := d.volumes.Get(volumeID)
+	if !ok || !vol.dev.Exists() {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not staged on this node", volumeID)
+	}
+	diskSize, err := vol.dev.GetDiskSize()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get disksize of %s: %v", vol.dev.devPath, err)
+	}
+	if diskSize >= pageAlign(capacity) {
+		klog.V(2).Infof("NodeExpandVolume: volume %s already has %d bytes", volumeID, diskSize)
+		if err := d.recordCapacity(volumeID, capacity); err != nil {
+			return nil, err
+		}
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: diskSize}, nil
+	}
+	published, err := d.publishedPaths(vol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check mounts of volume %s: %v", volumeID, err)
+	}
+	if len(published) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published, only offline expansion is supported", volumeID)
+	}
+
+	// recorded first, so that a volume staged again gets the capacity of its PV in any case
+	if err := d.recordCapacity(volumeID, capacity); err != nil {
+		return nil, err
+	}
+	if err := d.expandVolume(vol, capacity); err != nil {
+		return nil, err
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: capacity}, nil
 }
 
 // ensureMountPoint: create mount point if not exists
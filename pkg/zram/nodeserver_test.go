@@ -220,11 +220,58 @@ func TestNodeGetCapabilities(t *testing.T) {
 
 func TestNodeExpandVolume(t *testing.T) {
 	d := NewFakeDriver()
-	req := csi.NodeExpandVolumeRequest{}
-	resp, err := d.NodeExpandVolume(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil)}
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": "2097152\n"})
+	vol := &stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	vol.addTarget("/publish/pod_1", false)
+	d.volumes.Add(vol)
+	capacityRange := func(bytes int64) *csi.CapacityRange {
+		return &csi.CapacityRange{RequiredBytes: bytes}
+	}
+
+	tests := []struct {
+		desc             string
+		req              csi.NodeExpandVolumeRequest
+		expectedCapacity int64
+		expectedCode     codes.Code
+	}{
+		{
+			desc:         "Volume ID missing",
+			req:          csi.NodeExpandVolumeRequest{VolumePath: "/publish/pod_1", CapacityRange: capacityRange(1048576)},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "Volume path missing",
+			req:          csi.NodeExpandVolumeRequest{VolumeId: "vol_1", CapacityRange: capacityRange(1048576)},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "Capacity missing",
+			req:          csi.NodeExpandVolumeRequest{VolumeId: "vol_1", VolumePath: "/publish/pod_1"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "Volume not staged",
+			req:          csi.NodeExpandVolumeRequest{VolumeId: "vol_2", VolumePath: "/publish/pod_2", CapacityRange: capacityRange(1048576)},
+			expectedCode: codes.NotFound,
+		},
+		{
+			desc:             "Device large enough",
+			req:              csi.NodeExpandVolumeRequest{VolumeId: "vol_1", VolumePath: "/publish/pod_1", CapacityRange: capacityRange(2097152)},
+			expectedCapacity: 2097152,
+			expectedCode:     codes.OK,
+		},
+		{
+			desc:         "Volume published",
+			req:          csi.NodeExpandVolumeRequest{VolumeId: "vol_1", VolumePath: "/publish/pod_1", CapacityRange: capacityRange(4194304)},
+			expectedCode: codes.FailedPrecondition,
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := d.NodeExpandVolume(context.Background(), &test.req)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+		assert.Equal(t, test.expectedCapacity, resp.GetCapacityBytes(), test.desc)
 	}
 }
 
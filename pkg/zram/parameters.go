@@ -0,0 +1,304 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	compAlgorithmField = "compalgorithm"
+	memLimitField      = "memlimit"
+	backingDirField    = "backingdir"
+	backingSizeField   = "backingsize"
+	// writeback scheduling, requires a backing device
+	writebackIntervalField = "writebackinterval"
+	writebackIdleAgeField  = "writebackidleage"
+	writebackModeField     = "writebackmode"
+	// recompression with secondary algorithms
+	recompAlgorithmsField = "recompalgorithms"
+	recompPolicyField     = "recomppolicy"
+	recompThresholdField  = "recompthreshold"
+	recompIntervalField   = "recompinterval"
+	// algorithm_params of the primary algorithm
+	compLevelField      = "complevel"
+	compDictionaryField = "compdictionary"
+	// discard of the blocks freed by the filesystem
+	discardModeField    = "discardmode"
+	fstrimIntervalField = "fstriminterval"
+	// what to do when a volume is staged again after its data was lost
+	dataLossPolicyField = "datalosspolicy"
+)
+
+const (
+	writebackModeIdle     = "idle"
+	writebackModeHuge     = "huge"
+	writebackModeHugeIdle = "huge_idle"
+)
+
+const (
+	discardModeOnline = "online"
+	discardModeFstrim = "fstrim"
+)
+
+const (
+	dataLossPolicyRecreate = "recreate"
+	dataLossPolicyFail     = "fail"
+)
+
+// defaultFstrimInterval is used when discardMode is fstrim and no interval is given
+const defaultFstrimInterval = time.Hour
+
+// maxRecompAlgorithms is the number of secondary algorithms supported by zram
+const maxRecompAlgorithms = 3
+
+// volumeOptions holds the zram tunables of a volume, taken from the StorageClass
+// parameters and carried to the node in the volume context.
+type volumeOptions struct {
+	compAlgorithm string
+	// memLimit is either an absolute number of bytes or, when memLimitPercent is set,
+	// a percentage of the volume capacity.
+	memLimit        int64
+	memLimitPercent bool
+	// backingDir is the node directory holding the sparse file behind the writeback
+	// device, backingSize defaults to the volume capacity.
+	backingDir  string
+	backingSize int64
+	// writebackInterval enables the periodic writeback of pages of writebackMode to the backing
+	// device. Idle pages are written back once they have not been accessed for writebackIdleAge,
+	// or for a full interval when the age is not set.
+	writebackInterval time.Duration
+	writebackIdleAge  time.Duration
+	writebackMode     string
+	// recompAlgorithms are the secondary algorithms in priority order. Every recompInterval,
+	// the pages selected by recompPolicy ("idle", "huge" or "huge_idle") and compressed to
+	// more than recompThreshold bytes are recompressed.
+	recompAlgorithms []string
+	recompPolicy     string
+	recompThreshold  int64
+	recompInterval   time.Duration
+	// compLevel and compDictionary tune the primary algorithm, compDictionary is the name
+	// of a file in the driver dictionary directory. A zero compLevel keeps the default level.
+	compLevel      int
+	compDictionary string
+	// discardMode returns the memory of deleted files to the node, either by mounting the
+	// filesystem with the discard option ("online") or by trimming it every fstrimInterval ("fstrim").
+	discardMode    string
+	fstrimInterval time.Duration
+	// dataLossPolicy decides whether a volume whose data was lost, e.g. by a reboot of the node,
+	// is staged again with an empty filesystem ("recreate", the default) or refused ("fail").
+	dataLossPolicy string
+}
+
+// parseVolumeOptions parses the volume context, keys are case insensitive.
+// Keys not related to zram settings are ignored.
+func parseVolumeOptions(context map[string]string) (*volumeOptions, error) {
+	opts := &volumeOptions{}
+	for k, v := range context {
+		switch strings.ToLower(k) {
+		case compAlgorithmField:
+			if v == "" || strings.ContainsAny(v, " \t\n[]") {
+				return nil, fmt.Errorf("invalid %s: %q", k, v)
+			}
+			opts.compAlgorithm = v
+		case memLimitField:
+			if strings.HasSuffix(v, "%") {
+				percent, err := strconv.ParseInt(strings.TrimSuffix(v, "%"), 10, 64)
+				if err != nil || percent <= 0 || percent > 100 {
+					return nil, fmt.Errorf("invalid %s: %q, percentage must be between 1%% and 100%%", k, v)
+				}
+				opts.memLimit = percent
+				opts.memLimitPercent = true
+				continue
+			}
+			quantity, err := resource.ParseQuantity(v)
+			if err != nil || quantity.Value() <= 0 {
+				return nil, fmt.Errorf("invalid %s: %q", k, v)
+			}
+			opts.memLimit = quantity.Value()
+		case backingDirField:
+			if !filepath.IsAbs(v) {
+				return nil, fmt.Errorf("invalid %s: %q, must be an absolute path", k, v)
+			}
+			opts.backingDir = filepath.Clean(v)
+		case backingSizeField:
+			quantity, err := resource.ParseQuantity(v)
+			if err != nil || quantity.Value() <= 0 {
+				return nil, fmt.Errorf("invalid %s: %q", k, v)
+			}
+			opts.backingSize = quantity.Value()
+		case writebackIntervalField:
+			interval, err := parsePositiveDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", k, err)
+			}
+			opts.writebackInterval = interval
+		case writebackIdleAgeField:
+			age, err := parsePositiveDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", k, err)
+			}
+			opts.writebackIdleAge = age
+		case writebackModeField:
+			switch v {
+			case writebackModeIdle, writebackModeHuge, writebackModeHugeIdle:
+				opts.writebackMode = v
+			default:
+				return nil, fmt.Errorf("invalid %s: %q, supported modes: %s, %s, %s",
+					k, v, writebackModeIdle, writebackModeHuge, writebackModeHugeIdle)
+			}
+		case recompAlgorithmsField:
+			for _, a := range strings.Split(v, ",") {
+				a = strings.TrimSpace(a)
+				if a == "" || strings.ContainsAny(a, " \t\n[]") {
+					return nil, fmt.Errorf("invalid %s: %q", k, v)
+				}
+				opts.recompAlgorithms = append(opts.recompAlgorithms, a)
+			}
+			if len(opts.recompAlgorithms) > maxRecompAlgorithms {
+				return nil, fmt.Errorf("invalid %s: %q, at most %d algorithms are supported", k, v, maxRecompAlgorithms)
+			}
+		case recompPolicyField:
+			switch v {
+			case writebackModeIdle, writebackModeHuge, writebackModeHugeIdle:
+				opts.recompPolicy = v
+			default:
+				return nil, fmt.Errorf("invalid %s: %q, supported policies: %s, %s, %s",
+					k, v, writebackModeIdle, writebackModeHuge, writebackModeHugeIdle)
+			}
+		case recompThresholdField:
+			quantity, err := resource.ParseQuantity(v)
+			if err != nil || quantity.Value() <= 0 {
+				return nil, fmt.Errorf("invalid %s: %q", k, v)
+			}
+			opts.recompThreshold = quantity.Value()
+		case recompIntervalField:
+			interval, err := parsePositiveDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", k, err)
+			}
+			opts.recompInterval = interval
+		case compLevelField:
+			level, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", k, v)
+			}
+			opts.compLevel = level
+		case compDictionaryField:
+			if v == "" || v != filepath.Base(v) || v == ".." || v == "." {
+				return nil, fmt.Errorf("invalid %s: %q, must be a file name in the dictionary directory", k, v)
+			}
+			opts.compDictionary = v
+		case discardModeField:
+			switch v {
+			case discardModeOnline, discardModeFstrim:
+				opts.discardMode = v
+			default:
+				return nil, fmt.Errorf("invalid %s: %q, supported modes: %s, %s", k, v, discardModeOnline, discardModeFstrim)
+			}
+		case dataLossPolicyField:
+			switch v {
+			case dataLossPolicyRecreate, dataLossPolicyFail:
+				opts.dataLossPolicy = v
+			default:
+				return nil, fmt.Errorf("invalid %s: %q, supported policies: %s, %s", k, v, dataLossPolicyRecreate, dataLossPolicyFail)
+			}
+		case fstrimIntervalField:
+			interval, err := parsePositiveDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", k, err)
+			}
+			opts.fstrimInterval = interval
+		}
+	}
+	if opts.backingSize > 0 && opts.backingDir == "" {
+		return nil, fmt.Errorf("backingSize requires backingDir")
+	}
+	if (opts.writebackInterval > 0 || opts.writebackIdleAge > 0 || opts.writebackMode != "") && opts.backingDir == "" {
+		return nil, fmt.Errorf("writeback requires backingDir")
+	}
+	if opts.writebackIdleAge > 0 && opts.writebackInterval == 0 {
+		return nil, fmt.Errorf("writebackIdleAge requires writebackInterval")
+	}
+	if opts.writebackInterval > 0 && opts.writebackMode == "" {
+		opts.writebackMode = writebackModeIdle
+	}
+	if (opts.recompPolicy != "" || opts.recompThreshold > 0 || opts.recompInterval > 0) && len(opts.recompAlgorithms) == 0 {
+		return nil, fmt.Errorf("recompression requires recompAlgorithms")
+	}
+	if opts.recompInterval > 0 && opts.recompPolicy == "" && opts.recompThreshold == 0 {
+		return nil, fmt.Errorf("recompInterval requires recompPolicy or recompThreshold")
+	}
+	if opts.fstrimInterval > 0 && opts.discardMode != discardModeFstrim {
+		return nil, fmt.Errorf("fstrimInterval requires discardMode %s", discardModeFstrim)
+	}
+	if opts.discardMode == discardModeFstrim && opts.fstrimInterval == 0 {
+		opts.fstrimInterval = defaultFstrimInterval
+	}
+	return opts, nil
+}
+
+// parsePositiveDuration parses a duration such as "30m" that must be greater than zero.
+func parsePositiveDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q must be greater than zero", v)
+	}
+	return d, nil
+}
+
+// memLimitBytes returns the memory limit of a volume with the given capacity, 0 means no limit.
+func (o *volumeOptions) memLimitBytes(capacity int64) int64 {
+	if o.memLimitPercent {
+		return capacity * o.memLimit / 100
+	}
+	return o.memLimit
+}
+
+// hasAlgorithmParams returns true if the primary algorithm has to be tuned through algorithm_params.
+func (o *volumeOptions) hasAlgorithmParams() bool {
+	return o.compLevel != 0 || o.compDictionary != ""
+}
+
+// compAlgorithms returns all algorithms the volume asks for, primary first.
+func (o *volumeOptions) compAlgorithms() []string {
+	var algorithms []string
+	if o.compAlgorithm != "" {
+		algorithms = append(algorithms, o.compAlgorithm)
+	}
+	return append(algorithms, o.recompAlgorithms...)
+}
+
+// validateCompAlgorithm checks the algorithm against the list reported by the kernel.
+func validateCompAlgorithm(algorithm string, available []string) error {
+	for _, a := range available {
+		if a == algorithm {
+			return nil
+		}
+	}
+	return fmt.Errorf("compression algorithm %q is not supported, available algorithms: %s",
+		algorithm, strings.Join(available, " "))
+}
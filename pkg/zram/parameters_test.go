@@ -0,0 +1,263 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseVolumeOptions(t *testing.T) {
+	tests := []struct {
+		desc        string
+		context     map[string]string
+		expected    *volumeOptions
+		expectedErr bool
+	}{
+		{
+			desc:     "empty context",
+			context:  map[string]string{},
+			expected: &volumeOptions{},
+		},
+		{
+			desc:     "unrelated keys are ignored",
+			context:  map[string]string{capacityField: "1024", "csi.storage.k8s.io/pvc/name": "pvc"},
+			expected: &volumeOptions{},
+		},
+		{
+			desc:     "compression algorithm",
+			context:  map[string]string{"compAlgorithm": "zstd"},
+			expected: &volumeOptions{compAlgorithm: "zstd"},
+		},
+		{
+			desc:        "empty compression algorithm",
+			context:     map[string]string{"compAlgorithm": ""},
+			expectedErr: true,
+		},
+		{
+			desc:        "malformed compression algorithm",
+			context:     map[string]string{"compAlgorithm": "[zstd]"},
+			expectedErr: true,
+		},
+		{
+			desc:     "absolute memory limit",
+			context:  map[string]string{"memLimit": "512Mi"},
+			expected: &volumeOptions{memLimit: 512 * 1024 * 1024},
+		},
+		{
+			desc:     "memory limit in bytes",
+			context:  map[string]string{"memlimit": "1000000"},
+			expected: &volumeOptions{memLimit: 1000000},
+		},
+		{
+			desc:     "memory limit percentage",
+			context:  map[string]string{"memLimit": "50%"},
+			expected: &volumeOptions{memLimit: 50, memLimitPercent: true},
+		},
+		{
+			desc:        "memory limit percentage out of range",
+			context:     map[string]string{"memLimit": "150%"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid memory limit",
+			context:     map[string]string{"memLimit": "lots"},
+			expectedErr: true,
+		},
+		{
+			desc:     "backing device",
+			context:  map[string]string{"backingDir": "/var/lib/zram/", "backingSize": "10Gi"},
+			expected: &volumeOptions{backingDir: "/var/lib/zram", backingSize: 10 * 1024 * 1024 * 1024},
+		},
+		{
+			desc:        "relative backing directory",
+			context:     map[string]string{"backingDir": "zram"},
+			expectedErr: true,
+		},
+		{
+			desc:        "backing size without directory",
+			context:     map[string]string{"backingSize": "1Gi"},
+			expectedErr: true,
+		},
+		{
+			desc:     "writeback with default mode",
+			context:  map[string]string{"backingDir": "/var/lib/zram", "writebackInterval": "1h"},
+			expected: &volumeOptions{backingDir: "/var/lib/zram", writebackInterval: time.Hour, writebackMode: writebackModeIdle},
+		},
+		{
+			desc: "writeback with idle age",
+			context: map[string]string{"backingDir": "/var/lib/zram", "writebackInterval": "10m",
+				"writebackIdleAge": "2h", "writebackMode": "huge_idle"},
+			expected: &volumeOptions{backingDir: "/var/lib/zram", writebackInterval: 10 * time.Minute,
+				writebackIdleAge: 2 * time.Hour, writebackMode: writebackModeHugeIdle},
+		},
+		{
+			desc:        "writeback without backing device",
+			context:     map[string]string{"writebackInterval": "1h"},
+			expectedErr: true,
+		},
+		{
+			desc:        "idle age without interval",
+			context:     map[string]string{"backingDir": "/var/lib/zram", "writebackIdleAge": "1h"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid writeback interval",
+			context:     map[string]string{"backingDir": "/var/lib/zram", "writebackInterval": "-1h"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid writeback mode",
+			context:     map[string]string{"backingDir": "/var/lib/zram", "writebackInterval": "1h", "writebackMode": "cold"},
+			expectedErr: true,
+		},
+		{
+			desc: "recompression",
+			context: map[string]string{"recompAlgorithms": "zstd, deflate", "recompPolicy": "idle",
+				"recompThreshold": "3000", "recompInterval": "1h"},
+			expected: &volumeOptions{recompAlgorithms: []string{"zstd", "deflate"}, recompPolicy: "idle",
+				recompThreshold: 3000, recompInterval: time.Hour},
+		},
+		{
+			desc:        "too many secondary algorithms",
+			context:     map[string]string{"recompAlgorithms": "zstd,deflate,lz4hc,842"},
+			expectedErr: true,
+		},
+		{
+			desc:        "recompression policy without algorithms",
+			context:     map[string]string{"recompPolicy": "huge"},
+			expectedErr: true,
+		},
+		{
+			desc:        "recompression interval without policy",
+			context:     map[string]string{"recompAlgorithms": "zstd", "recompInterval": "1h"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid recompression policy",
+			context:     map[string]string{"recompAlgorithms": "zstd", "recompPolicy": "cold"},
+			expectedErr: true,
+		},
+		{
+			desc:     "compression level and dictionary",
+			context:  map[string]string{"compLevel": "12", "compDictionary": "logs.dict"},
+			expected: &volumeOptions{compLevel: 12, compDictionary: "logs.dict"},
+		},
+		{
+			desc:        "invalid compression level",
+			context:     map[string]string{"compLevel": "max"},
+			expectedErr: true,
+		},
+		{
+			desc:        "dictionary outside of the dictionary directory",
+			context:     map[string]string{"compDictionary": "../etc/passwd"},
+			expectedErr: true,
+		},
+		{
+			desc:     "online discard",
+			context:  map[string]string{"discardMode": "online"},
+			expected: &volumeOptions{discardMode: discardModeOnline},
+		},
+		{
+			desc:     "fstrim with default interval",
+			context:  map[string]string{"discardMode": "fstrim"},
+			expected: &volumeOptions{discardMode: discardModeFstrim, fstrimInterval: defaultFstrimInterval},
+		},
+		{
+			desc:     "fstrim with interval",
+			context:  map[string]string{"discardMode": "fstrim", "fstrimInterval": "10m"},
+			expected: &volumeOptions{discardMode: discardModeFstrim, fstrimInterval: 10 * time.Minute},
+		},
+		{
+			desc:        "fstrim interval with online discard",
+			context:     map[string]string{"discardMode": "online", "fstrimInterval": "10m"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid discard mode",
+			context:     map[string]string{"discardMode": "async"},
+			expectedErr: true,
+		},
+		{
+			desc:     "data loss policy",
+			context:  map[string]string{"dataLossPolicy": "fail"},
+			expected: &volumeOptions{dataLossPolicy: dataLossPolicyFail},
+		},
+		{
+			desc:        "invalid data loss policy",
+			context:     map[string]string{"dataLossPolicy": "ignore"},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		opts, err := parseVolumeOptions(test.context)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("test[%s]: expected error, got options %+v", test.desc, opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, test.expected) {
+			t.Errorf("test[%s]: unexpected output: %+v, expected result: %+v", test.desc, opts, test.expected)
+		}
+	}
+}
+
+func TestValidateCompAlgorithm(t *testing.T) {
+	available := []string{"lzo", "lzo-rle", "lz4", "zstd"}
+	if err := validateCompAlgorithm("zstd", available); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateCompAlgorithm("842", available); err == nil {
+		t.Errorf("expected error for unsupported algorithm")
+	}
+}
+
+func TestMemLimitBytes(t *testing.T) {
+	opts := &volumeOptions{}
+	if limit := opts.memLimitBytes(1000); limit != 0 {
+		t.Errorf("unexpected memory limit: %d", limit)
+	}
+	opts = &volumeOptions{memLimit: 300}
+	if limit := opts.memLimitBytes(1000); limit != 300 {
+		t.Errorf("unexpected memory limit: %d", limit)
+	}
+	opts = &volumeOptions{memLimit: 25, memLimitPercent: true}
+	if limit := opts.memLimitBytes(1000); limit != 250 {
+		t.Errorf("unexpected memory limit: %d", limit)
+	}
+	if limit := opts.memLimitBytes(1099); limit != 274 {
+		t.Errorf("unexpected memory limit: %d", limit)
+	}
+}
+
+func TestCompAlgorithms(t *testing.T) {
+	opts := &volumeOptions{}
+	if algorithms := opts.compAlgorithms(); len(algorithms) != 0 {
+		t.Errorf("unexpected algorithms: %v", algorithms)
+	}
+	opts = &volumeOptions{compAlgorithm: "lz4", recompAlgorithms: []string{"zstd", "deflate"}}
+	if algorithms := opts.compAlgorithms(); !reflect.DeepEqual(algorithms, []string{"lz4", "zstd", "deflate"}) {
+		t.Errorf("unexpected algorithms: %v", algorithms)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// reasons of the events emitted by the memory watchdog
+	eventReasonReadOnly  = "ZRAMMemoryLimitReadOnly"
+	eventReasonReadWrite = "ZRAMMemoryLimitReadWrite"
+)
+
+// watchMemoryUsage remounts the staged filesystems read-only once their zram device uses
+// readOnlyWatermark percent of its memory limit, before writes start failing at the block
+// layer and the filesystem aborts its journal. They are remounted read-write once the usage
+// drops below readOnlyRecoverWatermark, if set. Volumes with an operation in progress are
+// checked on the next run.
+func (d *Driver) watchMemoryUsage() {
+	for _, vol := range d.volumes.List() {
+		if vol.block {
+			continue
+		}
+		if acquired := d.volumeLocks.TryAcquire(vol.volumeID); !acquired {
+			continue
+		}
+		if current, ok := d.volumes.Get(vol.volumeID); ok && current == vol {
+			d.checkMemoryUsage(vol)
+		}
+		d.volumeLocks.Release(vol.volumeID)
+	}
+}
+
+func (d *Driver) checkMemoryUsage(vol *stagedVolume) {
+	mmStat, err := vol.dev.MMStat()
+	if err != nil {
+		klog.Warningf("watchdog: failed to get memory usage of %s: %v", vol.dev.devPath, err)
+		return
+	}
+	if mmStat.MemLimit == 0 {
+		return
+	}
+	usage := float64(mmStat.MemUsedTotal) * 100 / float64(mmStat.MemLimit)
+	readOnly := vol.isReadOnly()
+	switch {
+	case !readOnly && usage >= d.readOnlyWatermark:
+		klog.Errorf("watchdog: zram device %s of volume %s uses %.1f%% of its memory limit (%d of %d bytes), remounting %s read-only",
+			vol.dev.devPath, vol.volumeID, usage, mmStat.MemUsedTotal, mmStat.MemLimit, vol.stagingPath)
+		if err := d.remountReadOnly(vol); err != nil {
+			klog.Errorf("watchdog: failed to remount volume %s read-only: %v", vol.volumeID, err)
+			return
+		}
+		d.events.Event(vol.volumeID, eventTypeWarning, eventReasonReadOnly,
+			fmt.Sprintf("zram device %s on node %s uses %.1f%% of its memory limit, the volume was remounted read-only", vol.dev.devPath, d.NodeID, usage))
+	case readOnly && d.readOnlyRecoverWatermark > 0 && usage < d.readOnlyRecoverWatermark:
+		klog.V(2).Infof("watchdog: zram device %s of volume %s uses %.1f%% of its memory limit, remounting %s read-write",
+			vol.dev.devPath, vol.volumeID, usage, vol.stagingPath)
+		if err := d.remountReadWrite(vol); err != nil {
+			klog.Errorf("watchdog: failed to remount volume %s read-write: %v", vol.volumeID, err)
+			return
+		}
+		d.events.Event(vol.volumeID, eventTypeNormal, eventReasonReadWrite,
+			fmt.Sprintf("zram device %s on node %s uses %.1f%% of its memory limit, the volume was remounted read-write", vol.dev.devPath, d.NodeID, usage))
+	}
+}
+
+// remountReadOnly remounts the filesystem of the volume read-only, together with the bind
+// mounts of the published targets so that pods see it in their mount table.
+func (d *Driver) remountReadOnly(vol *stagedVolume) error {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return err
+	}
+	if err := d.mounter.Mount(vol.dev.devPath, vol.stagingPath, "", []string{"remount", "ro"}); err != nil {
+		return err
+	}
+
+	var targets []string
+	for _, mp := range mountPoints {
+		if mp.Device != vol.dev.devPath || mp.Path == vol.stagingPath || !hasMountOption(mp.Opts, "rw") {
+			continue
+		}
+		if err := d.mounter.Mount(vol.dev.devPath, mp.Path, "", []string{"remount", "bind", "ro"}); err != nil {
+			klog.Errorf("watchdog: failed to remount %s of volume %s read-only: %v", mp.Path, vol.volumeID, err)
+			continue
+		}
+		targets = append(targets, mp.Path)
+	}
+	vol.setReadOnly(true, targets)
+	return nil
+}
+
+// remountReadWrite reverts remountReadOnly, targets published read-only stay read-only.
+func (d *Driver) remountReadWrite(vol *stagedVolume) error {
+	if err := d.mounter.Mount(vol.dev.devPath, vol.stagingPath, "", []string{"remount", "rw"}); err != nil {
+		return err
+	}
+	_, targets := vol.readOnlyState()
+	vol.setReadOnly(false, nil)
+
+	for _, target := range targets {
+		if err := d.mounter.Mount(vol.dev.devPath, target, "", []string{"remount", "bind", "rw"}); err != nil {
+			klog.Errorf("watchdog: failed to remount %s of volume %s read-write: %v", target, vol.volumeID, err)
+		}
+	}
+	return nil
+}
+
+// stagingMountOptions returns the options to mount the filesystem of the volume with again,
+// read-only while the memory watchdog keeps it read-only.
+func (vol *stagedVolume) stagingMountOptions() []string {
+	if !vol.isReadOnly() {
+		return vol.mountOptions
+	}
+	return append(append([]string(nil), vol.mountOptions...), "ro")
+}
+
+func hasMountOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
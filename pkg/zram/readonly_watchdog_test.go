@@ -0,0 +1,127 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+)
+
+func TestWatchMemoryUsage(t *testing.T) {
+	d := NewFakeDriver()
+	d.readOnlyWatermark = 90
+	d.readOnlyRecoverWatermark = 80
+
+	dev := newFakeZRAMDevice(t, map[string]string{"mm_stat": "8192 4096 9216 10000 9216 0 0 0\n"})
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: dev.devPath, Path: "/staging/vol_1", Opts: []string{"rw"}},
+		{Device: dev.devPath, Path: "/publish/pod_1", Opts: []string{"rw"}},
+		{Device: dev.devPath, Path: "/publish/pod_2", Opts: []string{"ro"}},
+		{Device: "/dev/zram1", Path: "/publish/pod_3", Opts: []string{"rw"}},
+	})
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	events := &fakeEventRecorder{}
+	d.events = events
+	vol := &stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	d.volumes.Add(vol)
+
+	remounts := func() []mount.MountPoint {
+		mountPoints := fakeMounter.MountPoints[4:]
+		fakeMounter.MountPoints = fakeMounter.MountPoints[:4]
+		return mountPoints
+	}
+
+	// volumes with an operation in progress are skipped
+	assert.True(t, d.volumeLocks.TryAcquire("vol_1"))
+	d.watchMemoryUsage()
+	assert.False(t, vol.isReadOnly())
+	assert.Empty(t, remounts())
+	d.volumeLocks.Release("vol_1")
+
+	// 92% of the limit
+	d.watchMemoryUsage()
+	readOnly, targets := vol.readOnlyState()
+	assert.True(t, readOnly)
+	assert.Equal(t, []string{"/publish/pod_1"}, targets)
+	assert.Equal(t, []mount.MountPoint{
+		{Device: dev.devPath, Path: "/staging/vol_1", Opts: []string{"remount", "ro"}},
+		{Device: dev.devPath, Path: "/publish/pod_1", Opts: []string{"remount", "bind", "ro"}},
+	}, remounts())
+	assert.Equal(t, []string{"Warning vol_1 " + eventReasonReadOnly}, events.take())
+
+	// the state survives a registration of the volume on another device, e.g. by an expansion
+	expanded := &stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	d.registerVolume(expanded)
+	assert.True(t, expanded.isReadOnly())
+	assert.Equal(t, []string{"ro"}, expanded.stagingMountOptions())
+	d.registerVolume(vol)
+
+	// 85% of the limit, still above the recover watermark
+	writeFile := func(data string) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dev.sysPath, "mm_stat"), []byte(data), 0644))
+	}
+	writeFile("8192 4096 8500 10000 9216 0 0 0\n")
+	d.watchMemoryUsage()
+	assert.True(t, vol.isReadOnly())
+	assert.Empty(t, remounts())
+
+	// 70% of the limit
+	writeFile("8192 4096 7000 10000 9216 0 0 0\n")
+	d.watchMemoryUsage()
+	readOnly, targets = vol.readOnlyState()
+	assert.False(t, readOnly)
+	assert.Empty(t, targets)
+	assert.Equal(t, []mount.MountPoint{
+		{Device: dev.devPath, Path: "/staging/vol_1", Opts: []string{"remount", "rw"}},
+		{Device: dev.devPath, Path: "/publish/pod_1", Opts: []string{"remount", "bind", "rw"}},
+	}, remounts())
+	assert.Equal(t, []string{"Normal vol_1 " + eventReasonReadWrite}, events.take())
+
+	// volumes stay read-only without recover watermark
+	d.readOnlyRecoverWatermark = 0
+	writeFile("8192 4096 9500 10000 9216 0 0 0\n")
+	d.watchMemoryUsage()
+	writeFile("8192 4096 1000 10000 9216 0 0 0\n")
+	d.watchMemoryUsage()
+	assert.True(t, vol.isReadOnly())
+}
+
+// fakeEventRecorder keeps the type, volume and reason of the events recorded.
+type fakeEventRecorder struct {
+	mux    sync.Mutex
+	events []string
+}
+
+func (r *fakeEventRecorder) Event(volumeID, eventType, reason, message string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.events = append(r.events, fmt.Sprintf("%s %s %s", eventType, volumeID, reason))
+}
+
+func (r *fakeEventRecorder) take() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// recompressParams returns the value written to the recompress attribute for the volume policy.
+func recompressParams(opts *volumeOptions) string {
+	var params []string
+	if opts.recompPolicy != "" {
+		params = append(params, "type="+opts.recompPolicy)
+	}
+	if opts.recompThreshold > 0 {
+		params = append(params, fmt.Sprintf("threshold=%d", opts.recompThreshold))
+	}
+	return strings.Join(params, " ")
+}
+
+// recompressPages recompresses the pages selected by the volume policy with the secondary algorithms.
+//
+// Idle pages are marked after each run unless the writeback task already takes care of it,
+// so the next run recompresses the pages that have not been accessed for a whole interval.
+func recompressPages(dev *ZRAMDevice, opts *volumeOptions) {
+	params := recompressParams(opts)
+	if err := dev.Recompress(params); err != nil {
+		klog.Warningf("failed to recompress pages of %s with %q: %v", dev.devPath, params, err)
+	} else {
+		klog.V(4).Infof("recompressed pages of %s with %q", dev.devPath, params)
+	}
+	if opts.recompPolicy != writebackModeHuge && opts.recompPolicy != "" && !opts.writebackMarksIdle() {
+		if err := dev.MarkIdle("all"); err != nil {
+			klog.Warningf("failed to mark pages idle on %s: %v", dev.devPath, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecompressPages(t *testing.T) {
+	tests := []struct {
+		desc               string
+		opts               *volumeOptions
+		expectedRecompress string
+		expectedIdle       string
+	}{
+		{
+			desc:               "idle pages",
+			opts:               &volumeOptions{recompPolicy: "idle", recompInterval: time.Hour},
+			expectedRecompress: "type=idle",
+			expectedIdle:       "all",
+		},
+		{
+			desc:               "idle pages marked by writeback",
+			opts:               &volumeOptions{recompPolicy: "huge_idle", recompInterval: time.Hour, writebackInterval: time.Hour},
+			expectedRecompress: "type=huge_idle",
+		},
+		{
+			desc: "idle pages not marked by huge writeback",
+			opts: &volumeOptions{recompPolicy: "idle", recompInterval: time.Hour, writebackInterval: time.Hour,
+				writebackMode: writebackModeHuge},
+			expectedRecompress: "type=idle",
+			expectedIdle:       "all",
+		},
+		{
+			desc:               "huge pages above threshold",
+			opts:               &volumeOptions{recompPolicy: "huge", recompThreshold: 3000, recompInterval: time.Hour},
+			expectedRecompress: "type=huge threshold=3000",
+		},
+		{
+			desc:               "threshold only",
+			opts:               &volumeOptions{recompThreshold: 2048, recompInterval: time.Hour},
+			expectedRecompress: "threshold=2048",
+		},
+	}
+
+	for _, test := range tests {
+		dev := newFakeZRAMDevice(t, map[string]string{"idle": "", "recompress": ""})
+		recompressPages(dev, test.opts)
+
+		recompress, err := ioutil.ReadFile(filepath.Join(dev.sysPath, "recompress"))
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedRecompress, string(recompress), test.desc)
+		idle, err := ioutil.ReadFile(filepath.Join(dev.sysPath, "idle"))
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedIdle, string(idle), test.desc)
+	}
+}
@@ -0,0 +1,592 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boris257/csi-driver-zram/pkg/fs"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+// freezeFilesystem, thawFilesystem, newCopyDevice and releaseCopyDevice are replaced in tests.
+var (
+	freezeFilesystem  = fs.Freeze
+	thawFilesystem    = fs.Thaw
+	newCopyDevice     = NewZRAMDevice
+	releaseCopyDevice = releaseZRAMDevice
+)
+
+// volumeSnapshot is the metadata of a snapshot. The archive next to it holds the files of a
+// filesystem volume as a tar file, or the image of a raw block volume, compressed with zstd.
+type volumeSnapshot struct {
+	SnapshotID     string `json:"snapshotID"`
+	SourceVolumeID string `json:"sourceVolumeID"`
+	NodeID         string `json:"nodeID"`
+	Block          bool   `json:"block,omitempty"`
+	// SizeBytes is the disksize of the source volume, the minimum size of a volume restored from it
+	SizeBytes int64 `json:"sizeBytes"`
+	// ArchiveBytes is the size of the compressed archive and Checksum its sha256
+	ArchiveBytes int64     `json:"archiveBytes"`
+	Checksum     string    `json:"checksum"`
+	CreationTime time.Time `json:"creationTime"`
+}
+
+// snapshotStore keeps the archive of each snapshot and its metadata in a directory. The metadata
+// is written once the archive is complete, a snapshot without metadata does not exist.
+// A store without directory does not hold any snapshot.
+type snapshotStore struct {
+	dir string
+}
+
+func newSnapshotStore(dir string) *snapshotStore {
+	return &snapshotStore{dir: dir}
+}
+
+func (s *snapshotStore) path(snapshotID string) string {
+	return filepath.Join(s.dir, url.PathEscape(snapshotID)+".json")
+}
+
+// archivePath returns the path of the archive of a snapshot.
+func (s *snapshotStore) archivePath(snapshotID string, block bool) string {
+	if block {
+		return filepath.Join(s.dir, url.PathEscape(snapshotID)+".img.zst")
+	}
+	return filepath.Join(s.dir, url.PathEscape(snapshotID)+".tar.zst")
+}
+
+func (s *snapshotStore) Save(snap *volumeSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(snap.SnapshotID), data)
+}
+
+// Load returns the metadata of the snapshot, nil if there is none.
+func (s *snapshotStore) Load(snapshotID string) (*volumeSnapshot, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.path(snapshotID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	snap := &volumeSnapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("invalid metadata of snapshot %s: %v", snapshotID, err)
+	}
+	return snap, nil
+}
+
+// Delete removes the metadata of the snapshot first, so that a partly removed snapshot is gone.
+func (s *snapshotStore) Delete(snapshotID string) error {
+	if s.dir == "" {
+		return nil
+	}
+	for _, path := range []string{s.path(snapshotID), s.archivePath(snapshotID, false), s.archivePath(snapshotID, true)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the metadata of all snapshots, sorted by snapshot ID.
+func (s *snapshotStore) List() ([]*volumeSnapshot, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snaps []*volumeSnapshot
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		snapshotID, err := url.PathUnescape(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		snap, err := s.Load(snapshotID)
+		if err != nil {
+			return nil, err
+		}
+		if snap != nil {
+			snaps = append(snaps, snap)
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].SnapshotID < snaps[j].SnapshotID })
+	return snaps, nil
+}
+
+// RemoveIncomplete removes the temporary files of archives that were being written when the
+// driver stopped.
+func (s *snapshotStore) RemoveIncomplete() {
+	files, _ := filepath.Glob(filepath.Join(s.dir, ".tmp-*"))
+	for _, file := range files {
+		klog.V(2).Infof("removing incomplete snapshot archive %s", file)
+		if err := os.Remove(file); err != nil {
+			klog.Warningf("failed to remove %s: %v", file, err)
+		}
+	}
+}
+
+// copyMarkerPath returns the path of the marker recording the temporary zram device a
+// snapshot is archived from, the device is mounted on copyMountPath.
+func (s *snapshotStore) copyMarkerPath(snapshotID string) string {
+	return filepath.Join(s.dir, ".copy-"+url.PathEscape(snapshotID))
+}
+
+func (s *snapshotStore) copyMountPath(snapshotID string) string {
+	return s.copyMarkerPath(snapshotID) + ".mnt"
+}
+
+// snapshotBudgetKey holds the reservation of the temporary zram device of a snapshot.
+func snapshotBudgetKey(snapshotID string) string {
+	return "snapshot#" + snapshotID
+}
+
+// writeArchive compresses the content read from src with zstd into the archive of the snapshot
+// and records its size and checksum.
+func (s *snapshotStore) writeArchive(ex exec.Interface, snap *volumeSnapshot, src io.Reader) error {
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	hash := sha256.New()
+	var stderr bytes.Buffer
+	cmd := ex.Command("zstd", "-q", "-c", "-T0")
+	cmd.SetStdin(src)
+	cmd.SetStdout(io.MultiWriter(f, hash))
+	cmd.SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		f.Close()
+		return fmt.Errorf("zstd failed: %v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	snap.ArchiveBytes = info.Size()
+	snap.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	return os.Rename(f.Name(), s.archivePath(snap.SnapshotID, snap.Block))
+}
+
+// archiveFilesystem writes the files mounted at path to the archive of the snapshot as a tar file.
+func (s *snapshotStore) archiveFilesystem(ex exec.Interface, snap *volumeSnapshot, path string) error {
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	tar := ex.Command("tar", "-C", path, "--numeric-owner", "--xattrs", "-cf", "-", ".")
+	tar.SetStdout(pw)
+	tar.SetStderr(&stderr)
+	tarErr := make(chan error, 1)
+	go func() {
+		err := tar.Run()
+		pw.CloseWithError(err)
+		tarErr <- err
+	}()
+
+	err := s.writeArchive(ex, snap, pr)
+	// stops tar if zstd failed before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	terr := <-tarErr
+	if err != nil {
+		return err
+	}
+	if terr != nil {
+		return fmt.Errorf("tar failed: %v, output: %s", terr, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// archiveDevice writes the first size bytes of a block device to the archive of the snapshot.
+func (s *snapshotStore) archiveDevice(ex exec.Interface, snap *volumeSnapshot, devPath string, size int64) error {
+	dev, err := os.Open(devPath)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	return s.writeArchive(ex, snap, io.LimitReader(dev, size))
+}
+
+// freezeVolume calls fn while the filesystem of a staged volume is frozen, so that its content
+// is consistent, with its background tasks stopped as fstrim would block on the frozen
+// filesystem. Raw block volumes are not frozen. Writers of the volume block until fn returns,
+// so fn should only take a copy of the volume.
+func (d *Driver) freezeVolume(vol *stagedVolume, fn func() error) error {
+	d.volumeTasks.Stop(vol.volumeID)
+	defer d.startVolumeTasks(vol)
+	if vol.block {
+		return fn()
+	}
+	if err := freezeFilesystem(vol.stagingPath); err != nil {
+		return fmt.Errorf("failed to freeze %s: %v", vol.stagingPath, err)
+	}
+	defer func() {
+		if err := thawFilesystem(vol.stagingPath); err != nil {
+			klog.Errorf("failed to thaw %s of volume %s: %v", vol.stagingPath, vol.volumeID, err)
+		}
+	}()
+	return fn()
+}
+
+// thawStagedFilesystem thaws the filesystem of a volume staged before the driver started, in
+// case the driver stopped while it was frozen. Thawing a filesystem that is not frozen fails
+// with EINVAL.
+func (d *Driver) thawStagedFilesystem(volumeID, stagingPath string, dev *ZRAMDevice) {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list mount points: %v", err)
+		return
+	}
+	if mp, ok := findMountPoint(mountPoints, stagingPath); !ok || mp.Device != dev.devPath {
+		return
+	}
+	if err := thawFilesystem(stagingPath); err == nil {
+		klog.Warningf("filesystem of volume %s on %s was left frozen, thawed it", volumeID, stagingPath)
+	} else if err != unix.EINVAL {
+		klog.Errorf("failed to thaw filesystem of volume %s on %s: %v", volumeID, stagingPath, err)
+	}
+}
+
+// createSnapshot archives a staged volume. A filesystem volume is only frozen while it is copied
+// to a temporary zram device, the archive is made from the copy once it is thawed.
+func (d *Driver) createSnapshot(vol *stagedVolume, snapshotID string) (*volumeSnapshot, error) {
+	size, err := vol.dev.GetDiskSize()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get disksize of %s: %v", vol.dev.devPath, err)
+	}
+	snap := &volumeSnapshot{
+		SnapshotID:     snapshotID,
+		SourceVolumeID: vol.volumeID,
+		NodeID:         d.NodeID,
+		Block:          vol.block,
+		SizeBytes:      size,
+		CreationTime:   time.Now().UTC(),
+	}
+
+	start := time.Now()
+	if vol.block {
+		err = d.freezeVolume(vol, func() error {
+			return d.snapshots.archiveDevice(d.mounter.Exec, snap, vol.dev.devPath, size)
+		})
+	} else {
+		if err := d.budget.Reserve(snapshotBudgetKey(snapshotID), size); err != nil {
+			return nil, status.Errorf(codes.ResourceExhausted, "failed to copy volume %s for snapshot %s: %v", vol.volumeID, snapshotID, err)
+		}
+		err = d.archiveFilesystemCopy(vol, snap)
+		d.budget.Release(snapshotBudgetKey(snapshotID))
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to archive volume %s: %v", vol.volumeID, err)
+	}
+	if err := d.snapshots.Save(snap); err != nil {
+		if err := d.snapshots.Delete(snapshotID); err != nil {
+			klog.Warningf("failed to remove archive of snapshot %s: %v", snapshotID, err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to record snapshot %s: %v", snapshotID, err)
+	}
+	klog.V(2).Infof("CreateSnapshot: snapshot %s of volume %s, %d bytes compressed to %d in %v",
+		snapshotID, vol.volumeID, size, snap.ArchiveBytes, time.Since(start).Round(time.Millisecond))
+	return snap, nil
+}
+
+// archiveFilesystemCopy copies the device of a filesystem volume to a temporary zram device
+// while the volume is frozen, then archives the files of the copy mounted read-only. The
+// temporary device is recorded by a marker until it is removed, so that it is removed on start
+// if the driver stops in between.
+func (d *Driver) archiveFilesystemCopy(vol *stagedVolume, snap *volumeSnapshot) error {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return err
+	}
+	mp, ok := findMountPoint(mountPoints, vol.stagingPath)
+	if !ok {
+		return fmt.Errorf("staging path %s is not mounted", vol.stagingPath)
+	}
+	copyDev, err := newCopyDevice()
+	if err != nil {
+		return fmt.Errorf("failed to create zram device: %v", err)
+	}
+	marker := d.snapshots.copyMarkerPath(snap.SnapshotID)
+	defer d.removeSnapshotCopy(marker, copyDev)
+	bootID, err := readBootID()
+	if err != nil {
+		klog.Warningf("failed to get boot ID: %v", err)
+	}
+	if err := writeFileAtomic(marker, []byte(strconv.Itoa(copyDev.id)+"\n"+bootID+"\n")); err != nil {
+		return err
+	}
+	if err := copyDev.SetDiskSize(snap.SizeBytes); err != nil {
+		return fmt.Errorf("failed to set disksize of %s: %v", copyDev.devPath, err)
+	}
+
+	frozenAt := time.Now()
+	if err := d.freezeVolume(vol, func() error {
+		return copyDevice(copyDev.devPath, vol.dev.devPath, snap.SizeBytes)
+	}); err != nil {
+		return err
+	}
+	klog.V(2).Infof("CreateSnapshot: volume %s copied to %s while frozen for %v", vol.volumeID, copyDev.devPath,
+		time.Since(frozenAt).Round(time.Millisecond))
+
+	mountPath := d.snapshots.copyMountPath(snap.SnapshotID)
+	if err := os.MkdirAll(mountPath, 0750); err != nil {
+		return err
+	}
+	options := []string{"ro"}
+	if mp.Type == "xfs" {
+		// the copy has the UUID of the mounted source
+		options = append(options, "nouuid")
+	}
+	if err := d.mounter.Mount(copyDev.devPath, mountPath, mp.Type, options); err != nil {
+		return fmt.Errorf("failed to mount copy %s on %s: %v", copyDev.devPath, mountPath, err)
+	}
+	return d.snapshots.archiveFilesystem(d.mounter.Exec, snap, mountPath)
+}
+
+// removeSnapshotCopy unmounts and removes the temporary zram device of a snapshot. Its marker is
+// kept if the device cannot be removed, for another attempt on start.
+func (d *Driver) removeSnapshotCopy(marker string, dev *ZRAMDevice) {
+	if err := mount.CleanupMountPoint(marker+".mnt", d.mounter, false); err != nil {
+		klog.Errorf("failed to unmount %s: %v", marker+".mnt", err)
+		return
+	}
+	if dev.Exists() {
+		if err := releaseCopyDevice(dev); err != nil {
+			klog.Errorf("failed to remove temporary snapshot device %s: %v", dev.devPath, err)
+			return
+		}
+	}
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("failed to remove %s: %v", marker, err)
+	}
+}
+
+// removeSnapshotCopies removes the temporary zram devices of the snapshots interrupted by a stop
+// of the driver. The markers are kept on persistent storage with the snapshots: a marker written
+// before the last boot is only deleted, as its device is gone and the id may have been reused.
+func (d *Driver) removeSnapshotCopies() {
+	markers, _ := filepath.Glob(filepath.Join(d.snapshots.dir, ".copy-*"))
+	bootID, err := readBootID()
+	if err != nil {
+		klog.Warningf("failed to get boot ID: %v", err)
+	}
+	for _, marker := range markers {
+		if strings.HasSuffix(marker, ".mnt") {
+			continue
+		}
+		data, err := ioutil.ReadFile(marker)
+		if err != nil {
+			klog.Warningf("failed to read %s: %v", marker, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) < 2 || bootID == "" || strings.TrimSpace(lines[1]) != bootID {
+			klog.V(2).Infof("removing %s of an interrupted snapshot from before the last boot", marker)
+			if err := os.Remove(marker + ".mnt"); err != nil && !os.IsNotExist(err) {
+				klog.Warningf("failed to remove %s: %v", marker+".mnt", err)
+				continue
+			}
+			if err := os.Remove(marker); err != nil {
+				klog.Warningf("failed to remove %s: %v", marker, err)
+			}
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+		if err != nil {
+			klog.Warningf("invalid temporary snapshot device in %s: %v", marker, err)
+			continue
+		}
+		dev, _ := NewZRAMDeviceFromId(id)
+		klog.V(2).Infof("removing temporary snapshot device %s left behind by an interrupted snapshot", dev.devPath)
+		d.removeSnapshotCopy(marker, dev)
+	}
+}
+
+// readArchive decompresses the archive of the snapshot into dst and verifies its checksum.
+func (s *snapshotStore) readArchive(ex exec.Interface, snap *volumeSnapshot, dst io.Writer) error {
+	f, err := os.Open(s.archivePath(snap.SnapshotID, snap.Block))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	var stderr bytes.Buffer
+	cmd := ex.Command("zstd", "-q", "-d", "-c")
+	cmd.SetStdin(io.TeeReader(f, hash))
+	cmd.SetStdout(dst)
+	cmd.SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("zstd failed: %v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if checksum := "sha256:" + hex.EncodeToString(hash.Sum(nil)); checksum != snap.Checksum {
+		return fmt.Errorf("checksum %s of archive does not match %s", checksum, snap.Checksum)
+	}
+	return nil
+}
+
+// extractFilesystem extracts the files of the snapshot into the filesystem mounted at path.
+func (s *snapshotStore) extractFilesystem(ex exec.Interface, snap *volumeSnapshot, path string) error {
+	pr, pw := io.Pipe()
+	readErr := make(chan error, 1)
+	go func() {
+		err := s.readArchive(ex, snap, pw)
+		pw.CloseWithError(err)
+		readErr <- err
+	}()
+
+	var stderr bytes.Buffer
+	tar := ex.Command("tar", "-C", path, "--numeric-owner", "--xattrs", "-xf", "-")
+	tar.SetStdin(pr)
+	tar.SetStderr(&stderr)
+	err := tar.Run()
+	// stops zstd if tar failed before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	if rerr := <-readErr; rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return fmt.Errorf("tar failed: %v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// restoreDevice writes the image of the snapshot to a block device.
+func (s *snapshotStore) restoreDevice(ex exec.Interface, snap *volumeSnapshot, devPath string) error {
+	dev, err := os.OpenFile(devPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := s.readArchive(ex, snap, dev); err != nil {
+		dev.Close()
+		return err
+	}
+	if err := dev.Sync(); err != nil {
+		dev.Close()
+		return err
+	}
+	return dev.Close()
+}
+
+// restoreSource returns the snapshot a volume is restored from, nil if it is not restored
+// from a snapshot. The snapshot must be on this node, of the same volume mode and fit in the
+// capacity of the volume.
+func (d *Driver) restoreSource(context map[string]string, capacity int64, block bool) (*volumeSnapshot, error) {
+	snapshotID := context[snapshotIDField]
+	if snapshotID == "" {
+		return nil, nil
+	}
+	snap, err := d.snapshots.Load(snapshotID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get snapshot %s: %v", snapshotID, err)
+	}
+	if snap == nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s is not on node %s", snapshotID, d.NodeID)
+	}
+	if snap.Block != block {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot %s of a %s volume cannot be restored to a %s volume",
+			snapshotID, volumeMode(snap.Block), volumeMode(block))
+	}
+	if capacity > 0 && snap.SizeBytes > capacity {
+		return nil, status.Errorf(codes.OutOfRange, "snapshot %s of %d bytes does not fit in %d bytes", snapshotID, snap.SizeBytes, capacity)
+	}
+	return snap, nil
+}
+
+func volumeMode(block bool) string {
+	if block {
+		return "block"
+	}
+	return "filesystem"
+}
+
+// restoreSnapshot fills the new device of a volume being staged with the content of the
+// snapshot, the files of a filesystem volume are extracted into its staging path.
+func (d *Driver) restoreSnapshot(state *volumeState, dev *ZRAMDevice, snap *volumeSnapshot) error {
+	if err := d.state.SetIntent(state, intentRestore); err != nil {
+		return status.Errorf(codes.Internal, "failed to record state of volume %s: %v", state.VolumeID, err)
+	}
+	start := time.Now()
+	var err error
+	if state.Block {
+		err = d.snapshots.restoreDevice(d.mounter.Exec, snap, dev.devPath)
+	} else {
+		err = d.snapshots.extractFilesystem(d.mounter.Exec, snap, state.StagingPath)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to restore snapshot %s to volume %s: %v", snap.SnapshotID, state.VolumeID, err)
+	}
+	klog.V(2).Infof("NodeStageVolume: snapshot %s restored to volume %s on %s in %v",
+		snap.SnapshotID, state.VolumeID, dev.devPath, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// csiSnapshot describes a snapshot in CSI responses, snapshots are ready once they are recorded.
+func csiSnapshot(snap *volumeSnapshot) (*csi.Snapshot, error) {
+	creationTime, err := ptypes.TimestampProto(snap.CreationTime)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid creation time of snapshot %s: %v", snap.SnapshotID, err)
+	}
+	return &csi.Snapshot{
+		SnapshotId:     snap.SnapshotID,
+		SourceVolumeId: snap.SourceVolumeID,
+		SizeBytes:      snap.SizeBytes,
+		CreationTime:   creationTime,
+		ReadyToUse:     true,
+	}, nil
+}
@@ -0,0 +1,467 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	s := newSnapshotStore(t.TempDir())
+
+	snap, err := s.Load("snap_1")
+	assert.NoError(t, err)
+	assert.Nil(t, snap)
+
+	created := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, id := range []string{"snap_2", "snap/1"} {
+		assert.NoError(t, s.Save(&volumeSnapshot{SnapshotID: id, SourceVolumeID: "vol_1", SizeBytes: 1048576, CreationTime: created}))
+	}
+	assert.NoError(t, ioutil.WriteFile(s.archivePath("snap_2", false), []byte("archive"), 0644))
+
+	snaps, err := s.List()
+	assert.NoError(t, err)
+	assert.Len(t, snaps, 2)
+	assert.Equal(t, "snap/1", snaps[0].SnapshotID)
+	assert.Equal(t, &volumeSnapshot{SnapshotID: "snap_2", SourceVolumeID: "vol_1", SizeBytes: 1048576, CreationTime: created}, snaps[1])
+
+	assert.NoError(t, s.Delete("snap_2"))
+	assert.NoError(t, s.Delete("snap_2"))
+	assert.NoFileExists(t, s.archivePath("snap_2", false))
+	snaps, err = s.List()
+	assert.NoError(t, err)
+	assert.Len(t, snaps, 1)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(s.dir, ".tmp-123"), nil, 0644))
+	s.RemoveIncomplete()
+	assert.NoFileExists(t, filepath.Join(s.dir, ".tmp-123"))
+}
+
+func newSnapshotDriver(t *testing.T) *Driver {
+	if _, err := exec.New().LookPath("zstd"); err != nil {
+		t.Skip("zstd not found")
+	}
+	d := NewFakeDriver()
+	d.snapshots = newSnapshotStore(t.TempDir())
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil), Exec: exec.New()}
+	return d
+}
+
+func assertArchive(t *testing.T, s *snapshotStore, snap *volumeSnapshot) {
+	data, err := ioutil.ReadFile(s.archivePath(snap.SnapshotID, snap.Block))
+	assert.NoError(t, err)
+	sum := sha256.Sum256(data)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), snap.Checksum)
+	assert.Equal(t, int64(len(data)), snap.ArchiveBytes)
+	// zstd frame magic number
+	assert.Equal(t, []byte{0x28, 0xb5, 0x2f, 0xfd}, data[:4])
+}
+
+// fakeSnapshotCopy replaces the temporary device snapshots of filesystem volumes are copied to
+// with an image file, and returns a function reporting whether it was released.
+func fakeSnapshotCopy(t *testing.T) (*ZRAMDevice, func() bool) {
+	copyDev := newFakeZRAMDevice(t, map[string]string{"disksize": "0\n"})
+	copyDev.id = 1
+	copyDev.devPath = filepath.Join(t.TempDir(), "zram1")
+	assert.NoError(t, ioutil.WriteFile(copyDev.devPath, nil, 0644))
+	released := false
+	origNew, origRelease := newCopyDevice, releaseCopyDevice
+	newCopyDevice = func() (*ZRAMDevice, error) { return copyDev, nil }
+	releaseCopyDevice = func(dev *ZRAMDevice) error { released = dev == copyDev; return nil }
+	t.Cleanup(func() { newCopyDevice, releaseCopyDevice = origNew, origRelease })
+	return copyDev, func() bool { return released }
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	d := newSnapshotDriver(t)
+	var frozen []string
+	origFreeze, origThaw := freezeFilesystem, thawFilesystem
+	copyDev, released := fakeSnapshotCopy(t)
+	freezeFilesystem = func(path string) error { frozen = append(frozen, "freeze "+path); return nil }
+	thawFilesystem = func(path string) error {
+		// the copy is complete once the volume is thawed
+		data, err := ioutil.ReadFile(copyDev.devPath)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("filesystem"), data[:10])
+		frozen = append(frozen, "thaw "+path)
+		return nil
+	}
+	defer func() { freezeFilesystem, thawFilesystem = origFreeze, origThaw }()
+
+	stagingPath := t.TempDir()
+	image := filepath.Join(t.TempDir(), "zram0")
+	assert.NoError(t, ioutil.WriteFile(image, append([]byte("filesystem"), make([]byte, 1<<20)...), 0644))
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": "1048576\n"})
+	dev.devPath = image
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: image, Path: stagingPath, Type: "xfs"}})
+	d.mounter.Interface = fakeMounter
+	d.volumes.Add(&stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: stagingPath, opts: &volumeOptions{}})
+
+	resp, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap_1", SourceVolumeId: "vol_1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "snap_1", resp.Snapshot.SnapshotId)
+	assert.Equal(t, "vol_1", resp.Snapshot.SourceVolumeId)
+	assert.Equal(t, int64(1048576), resp.Snapshot.SizeBytes)
+	assert.True(t, resp.Snapshot.ReadyToUse)
+	assert.Equal(t, []string{"freeze " + stagingPath, "thaw " + stagingPath}, frozen)
+
+	// the archive is made from the copy mounted read-only, which is removed afterwards
+	copyMount := d.snapshots.copyMountPath("snap_1")
+	assert.Contains(t, fakeMounter.GetLog(), mount.FakeAction{Action: mount.FakeActionMount, Target: copyMount, Source: copyDev.devPath, FSType: "xfs"})
+	assert.Contains(t, fakeMounter.GetLog(), mount.FakeAction{Action: mount.FakeActionUnmount, Target: copyMount})
+	assert.True(t, released())
+	assert.NoFileExists(t, d.snapshots.copyMarkerPath("snap_1"))
+	assert.Empty(t, d.budget.reservations)
+
+	snap, err := d.snapshots.Load("snap_1")
+	assert.NoError(t, err)
+	assert.Equal(t, fakeNodeID, snap.NodeID)
+	assertArchive(t, d.snapshots, snap)
+
+	// retried
+	resp, err = d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap_1", SourceVolumeId: "vol_1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "snap_1", resp.Snapshot.SnapshotId)
+	assert.Len(t, frozen, 2)
+
+	tests := []struct {
+		desc         string
+		req          *csi.CreateSnapshotRequest
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "name missing",
+			req:          &csi.CreateSnapshotRequest{SourceVolumeId: "vol_1"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "source volume missing",
+			req:          &csi.CreateSnapshotRequest{Name: "snap_2"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "source volume not staged",
+			req:          &csi.CreateSnapshotRequest{Name: "snap_2", SourceVolumeId: "vol_2"},
+			expectedCode: codes.NotFound,
+		},
+		{
+			desc:         "name taken by another volume",
+			req:          &csi.CreateSnapshotRequest{Name: "snap_1", SourceVolumeId: "vol_2"},
+			expectedCode: codes.AlreadyExists,
+		},
+	}
+	for _, test := range tests {
+		_, err := d.CreateSnapshot(context.Background(), test.req)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+	}
+
+	d.snapshots = newSnapshotStore("")
+	_, err = d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap_1", SourceVolumeId: "vol_1"})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestCreateBlockSnapshot(t *testing.T) {
+	d := newSnapshotDriver(t)
+	image := filepath.Join(t.TempDir(), "zram0")
+	assert.NoError(t, ioutil.WriteFile(image, append([]byte("block"), make([]byte, 8192)...), 0644))
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": "4096\n"})
+	dev.devPath = image
+	d.volumes.Add(&stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: "/staging/vol_1", opts: &volumeOptions{}, block: true})
+
+	_, err := d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap_1", SourceVolumeId: "vol_1"})
+	assert.NoError(t, err)
+	snap, err := d.snapshots.Load("snap_1")
+	assert.NoError(t, err)
+	assert.True(t, snap.Block)
+	assert.Equal(t, int64(4096), snap.SizeBytes)
+	assertArchive(t, d.snapshots, snap)
+}
+
+func TestRemoveSnapshotCopies(t *testing.T) {
+	d := NewFakeDriver()
+	d.snapshots = newSnapshotStore(t.TempDir())
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter(nil), Exec: exec.New()}
+	_, released := fakeSnapshotCopy(t)
+	origBootIDPath := bootIDPath
+	bootIDPath = filepath.Join(t.TempDir(), "boot_id")
+	defer func() { bootIDPath = origBootIDPath }()
+	assert.NoError(t, ioutil.WriteFile(bootIDPath, []byte("boot-1\n"), 0644))
+
+	// a marker of a previous boot is deleted without touching the device with its id
+	stale := d.snapshots.copyMarkerPath("snap_3")
+	assert.NoError(t, ioutil.WriteFile(stale, []byte("1\nboot-0\n"), 0644))
+	assert.NoError(t, os.MkdirAll(d.snapshots.copyMountPath("snap_3"), 0750))
+	legacy := d.snapshots.copyMarkerPath("snap_4")
+	assert.NoError(t, ioutil.WriteFile(legacy, []byte("1"), 0644))
+	d.removeSnapshotCopies()
+	assert.NoFileExists(t, stale)
+	assert.NoDirExists(t, d.snapshots.copyMountPath("snap_3"))
+	assert.NoFileExists(t, legacy)
+	assert.False(t, released())
+
+	marker := d.snapshots.copyMarkerPath("snap_1")
+	assert.NoError(t, ioutil.WriteFile(marker, []byte("1\nboot-1\n"), 0644))
+	assert.NoError(t, os.MkdirAll(d.snapshots.copyMountPath("snap_1"), 0750))
+	invalid := d.snapshots.copyMarkerPath("snap_2")
+	assert.NoError(t, ioutil.WriteFile(invalid, []byte("zram\nboot-1\n"), 0644))
+
+	d.removeSnapshotCopies()
+	assert.NoFileExists(t, marker)
+	assert.NoDirExists(t, d.snapshots.copyMountPath("snap_1"))
+	assert.FileExists(t, invalid)
+}
+
+func TestThawStagedFilesystem(t *testing.T) {
+	var thawed []string
+	origThaw := thawFilesystem
+	thawFilesystem = func(path string) error { thawed = append(thawed, path); return nil }
+	defer func() { thawFilesystem = origThaw }()
+
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{Interface: mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "/dev/zram0", Path: "/staging/vol_1"},
+		{Device: "/dev/zram5", Path: "/staging/vol_2"},
+	})}
+	dev, _ := NewZRAMDeviceFromId(0)
+	d.thawStagedFilesystem("vol_1", "/staging/vol_1", dev)
+	d.thawStagedFilesystem("vol_2", "/staging/vol_2", dev)
+	d.thawStagedFilesystem("vol_3", "/staging/vol_3", dev)
+	assert.Equal(t, []string{"/staging/vol_1"}, thawed)
+}
+
+func TestListSnapshots(t *testing.T) {
+	d := NewFakeDriver()
+	d.snapshots = newSnapshotStore(t.TempDir())
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, d.snapshots.Save(&volumeSnapshot{SnapshotID: fmt.Sprintf("snap_%d", i), SourceVolumeID: fmt.Sprintf("vol_%d", i%2),
+			SizeBytes: 1048576, CreationTime: time.Now()}))
+	}
+
+	resp, err := d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 2)
+	assert.Equal(t, "snap_1", resp.Entries[0].Snapshot.SnapshotId)
+	assert.Equal(t, "vol_1", resp.Entries[0].Snapshot.SourceVolumeId)
+	assert.Equal(t, "2", resp.NextToken)
+
+	resp, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: resp.NextToken})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 1)
+	assert.Equal(t, "snap_3", resp.Entries[0].Snapshot.SnapshotId)
+	assert.Empty(t, resp.NextToken)
+
+	resp, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: "vol_1"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 2)
+
+	resp, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "snap_2"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 1)
+	assert.Equal(t, "vol_0", resp.Entries[0].Snapshot.SourceVolumeId)
+
+	resp, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "snap_4"})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Entries)
+
+	_, err = d.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "4"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	d := NewFakeDriver()
+	d.snapshots = newSnapshotStore(t.TempDir())
+	assert.NoError(t, d.snapshots.Save(&volumeSnapshot{SnapshotID: "snap_1", SourceVolumeID: "vol_1"}))
+	assert.NoError(t, ioutil.WriteFile(d.snapshots.archivePath("snap_1", false), []byte("archive"), 0644))
+
+	for i := 0; i < 2; i++ {
+		_, err := d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snap_1"})
+		assert.NoError(t, err)
+	}
+	assert.NoFileExists(t, d.snapshots.path("snap_1"))
+	assert.NoFileExists(t, d.snapshots.archivePath("snap_1", false))
+
+	_, err := d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a snapshot being created is not deleted concurrently, and the other way round
+	assert.True(t, d.volumeLocks.TryAcquire(snapshotLockKey("snap_2")))
+	_, err = d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snap_2"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = d.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snap_2", SourceVolumeId: "vol_1"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	d.volumeLocks.Release(snapshotLockKey("snap_2"))
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	d := newSnapshotDriver(t)
+	source := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "cache"), 0750))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "cache", "data"), []byte("cached state"), 0640))
+
+	snap := &volumeSnapshot{SnapshotID: "snap_1", SourceVolumeID: "vol_1"}
+	assert.NoError(t, d.snapshots.archiveFilesystem(d.mounter.Exec, snap, source))
+	target := t.TempDir()
+	state := newVolumeState("vol_2", target, nil, false)
+	assert.NoError(t, d.restoreSnapshot(state, newFakeZRAMDevice(t, nil), snap))
+	data, err := ioutil.ReadFile(filepath.Join(target, "cache", "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, "cached state", string(data))
+
+	// corrupted archive
+	snap.Checksum = "sha256:0"
+	assert.Error(t, d.restoreSnapshot(state, newFakeZRAMDevice(t, nil), snap))
+
+	image := filepath.Join(t.TempDir(), "zram0")
+	content := append([]byte("block"), make([]byte, 4091)...)
+	assert.NoError(t, ioutil.WriteFile(image, content, 0644))
+	snap = &volumeSnapshot{SnapshotID: "snap_2", SourceVolumeID: "vol_1", Block: true}
+	assert.NoError(t, d.snapshots.archiveDevice(d.mounter.Exec, snap, image, 4096))
+	restored := filepath.Join(t.TempDir(), "zram1")
+	assert.NoError(t, ioutil.WriteFile(restored, make([]byte, 8192), 0644))
+	dev := newFakeZRAMDevice(t, nil)
+	dev.devPath = restored
+	assert.NoError(t, d.restoreSnapshot(newVolumeState("vol_2", "/staging/vol_2", nil, true), dev, snap))
+	data, err = ioutil.ReadFile(restored)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data[:4096])
+}
+
+func TestRestoreSource(t *testing.T) {
+	d := NewFakeDriver()
+	d.snapshots = newSnapshotStore(t.TempDir())
+	assert.NoError(t, d.snapshots.Save(&volumeSnapshot{SnapshotID: "snap_1", SourceVolumeID: "vol_1", SizeBytes: 1048576}))
+
+	snap, err := d.restoreSource(map[string]string{}, 1048576, false)
+	assert.NoError(t, err)
+	assert.Nil(t, snap)
+
+	snap, err = d.restoreSource(map[string]string{snapshotIDField: "snap_1"}, 1048576, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "snap_1", snap.SnapshotID)
+
+	_, err = d.restoreSource(map[string]string{snapshotIDField: "snap_2"}, 1048576, false)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = d.restoreSource(map[string]string{snapshotIDField: "snap_1"}, 1048576, true)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = d.restoreSource(map[string]string{snapshotIDField: "snap_1"}, 4096, false)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func TestVolumeContentSourceRestoredOnce(t *testing.T) {
+	d := NewFakeDriver()
+	d.snapshots = newSnapshotStore(t.TempDir())
+	d.records = newRecordStore(t.TempDir())
+	assert.NoError(t, d.snapshots.Save(&volumeSnapshot{SnapshotID: "snap_1", SourceVolumeID: "vol_1", SizeBytes: 1048576}))
+	volumeContext := map[string]string{snapshotIDField: "snap_1"}
+
+	source, err := d.volumeContentSource("vol_2", volumeContext, 1048576, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "snap_1", source.snapshot.SnapshotID)
+
+	d.recordPopulated("vol_2")
+	assert.NoError(t, d.snapshots.Delete("snap_1"))
+	// staged again after the snapshot was deleted
+	source, err = d.volumeContentSource("vol_2", volumeContext, 1048576, false)
+	assert.NoError(t, err)
+	assert.Nil(t, source)
+
+	// never populated
+	_, err = d.volumeContentSource("vol_3", volumeContext, 1048576, false)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	d := NewFakeDriver()
+	d.snapshots = newSnapshotStore(t.TempDir())
+	assert.NoError(t, d.snapshots.Save(&volumeSnapshot{SnapshotID: "snap_1", SourceVolumeID: "vol_1", SizeBytes: 1048576}))
+
+	mountCap := []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}}
+	blockCap := []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}}
+	snapshotSource := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: id}},
+		}
+	}
+
+	resp, err := d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+		VolumeContentSource: snapshotSource("snap_1")})
+	assert.NoError(t, err)
+	assert.Equal(t, "snap_1", resp.Volume.VolumeContext[snapshotIDField])
+	assert.Equal(t, "1048576", resp.Volume.VolumeContext[capacityField])
+	assert.Equal(t, "snap_1", resp.Volume.ContentSource.GetSnapshot().GetSnapshotId())
+
+	resp, err = d.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "vol_3", VolumeCapabilities: mountCap,
+		Parameters: map[string]string{snapshotIDField: "snap_1"}})
+	assert.NoError(t, err)
+	assert.NotContains(t, resp.Volume.VolumeContext, snapshotIDField)
+
+	tests := []struct {
+		desc         string
+		req          *csi.CreateVolumeRequest
+		expectedCode codes.Code
+	}{
+		{
+			desc: "snapshot not on node",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				VolumeContentSource: snapshotSource("snap_2")},
+			expectedCode: codes.NotFound,
+		},
+		{
+			desc: "capacity smaller than snapshot",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 4096}, VolumeContentSource: snapshotSource("snap_1")},
+			expectedCode: codes.OutOfRange,
+		},
+		{
+			desc: "capacity limit smaller than snapshot",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				CapacityRange: &csi.CapacityRange{LimitBytes: 4096}, VolumeContentSource: snapshotSource("snap_1")},
+			expectedCode: codes.OutOfRange,
+		},
+		{
+			desc: "block volume from filesystem snapshot",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: blockCap,
+				VolumeContentSource: snapshotSource("snap_1")},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc: "snapshot ID missing",
+			req: &csi.CreateVolumeRequest{Name: "vol_2", VolumeCapabilities: mountCap,
+				VolumeContentSource: snapshotSource("")},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+	for _, test := range tests {
+		_, err := d.CreateVolume(context.Background(), test.req)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// volumePhase is the lifecycle phase of a volume on the node.
+type volumePhase string
+
+const (
+	// phaseStaging is recorded before the zram device of a volume is added, a volume still
+	// in this phase on start was interrupted and is rolled back.
+	phaseStaging volumePhase = "Staging"
+	phaseStaged  volumePhase = "Staged"
+	// phaseUnstaging is recorded before a volume is unmounted, a volume still in this phase
+	// on start was interrupted and its removal is completed.
+	phaseUnstaging volumePhase = "Unstaging"
+)
+
+// intents name the sysfs or mount operation about to be made on the device of a volume.
+const (
+	intentHotAdd    = "hot_add"
+	intentConfigure = "configure"
+	intentMount     = "mount"
+	intentRestore   = "restore"
+	intentUnmount   = "unmount"
+	intentHotRemove = "hot_remove"
+	// intentExpand is recorded while a staged volume is migrated to the device ExpandDeviceID,
+	// the migration is rolled back if it is still recorded on start.
+	intentExpand = "expand"
+)
+
+// volumeState is the record of a volume kept in the state store.
+type volumeState struct {
+	VolumeID string `json:"volumeID"`
+	// DeviceID is the number of the zram device, -1 until it is added
+	DeviceID    int               `json:"deviceID"`
+	StagingPath string            `json:"stagingPath"`
+	Block       bool              `json:"block,omitempty"`
+	Parameters  map[string]string `json:"parameters,omitempty"`
+	// MountOptions are the options the filesystem is mounted with on the staging path
+	MountOptions []string `json:"mountOptions,omitempty"`
+	// PublishTargets maps the paths the volume is published on to whether they are read-only
+	PublishTargets map[string]bool `json:"publishTargets,omitempty"`
+	Phase          volumePhase     `json:"phase"`
+	// Intent is the operation in progress, it is recorded before the operation is made
+	Intent string `json:"intent,omitempty"`
+	// ExpandDeviceID is the device an expansion migrates the volume to, nil if none
+	ExpandDeviceID *int `json:"expandDeviceID,omitempty"`
+	// TrimmedBytes is the number of bytes discarded by fstrim since the volume was staged
+	TrimmedBytes uint64 `json:"trimmedBytes,omitempty"`
+}
+
+// expandDevice returns the number of the device the volume is migrated to while intentExpand
+// is recorded. Records written before the field was a pointer omitted device 0.
+func (s *volumeState) expandDevice() int {
+	if s.ExpandDeviceID == nil {
+		return 0
+	}
+	return *s.ExpandDeviceID
+}
+
+func newVolumeState(volumeID, stagingPath string, parameters map[string]string, block bool) *volumeState {
+	return &volumeState{
+		VolumeID:    volumeID,
+		DeviceID:    -1,
+		StagingPath: stagingPath,
+		Block:       block,
+		Parameters:  parameters,
+		Phase:       phaseStaging,
+	}
+}
+
+// stateStore keeps one JSON file per volume in a directory, each file is replaced atomically.
+// A store without directory does not record anything.
+type stateStore struct {
+	dir string
+}
+
+func newStateStore(dir string) *stateStore {
+	return &stateStore{dir: dir}
+}
+
+func (s *stateStore) path(volumeID string) string {
+	return filepath.Join(s.dir, url.PathEscape(volumeID)+".json")
+}
+
+// Save writes the record of the volume through a temporary file renamed over the previous record.
+func (s *stateStore) Save(state *volumeState) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(state.VolumeID), data)
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path, syncs it and renames
+// it over path, so that readers see either the previous or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// SetIntent records the operation about to be made on the device of the volume.
+func (s *stateStore) SetIntent(state *volumeState, intent string) error {
+	state.Intent = intent
+	return s.Save(state)
+}
+
+// Load returns the record of the volume, nil if there is none.
+func (s *stateStore) Load(volumeID string) (*volumeState, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.path(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &volumeState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state of volume %s: %v", volumeID, err)
+	}
+	return state, nil
+}
+
+func (s *stateStore) Delete(volumeID string) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(volumeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the records of all volumes, sorted by file name.
+func (s *stateStore) List() ([]*volumeState, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var states []*volumeState
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		volumeID, err := url.PathUnescape(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		state, err := s.Load(volumeID)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
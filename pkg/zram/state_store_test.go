@@ -0,0 +1,100 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateStore(t *testing.T) {
+	s := newStateStore(t.TempDir())
+
+	state, err := s.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	state1 := newVolumeState("vol#1/a", "/staging/vol_1", map[string]string{capacityField: "1048576"}, false)
+	assert.NoError(t, s.SetIntent(state1, intentHotAdd))
+	state1.DeviceID = 3
+	assert.NoError(t, s.SetIntent(state1, intentConfigure))
+	state2 := newVolumeState("vol_2", "/staging/vol_2", nil, true)
+	state2.DeviceID = 4
+	state2.Phase = phaseStaged
+	assert.NoError(t, s.Save(state2))
+
+	loaded, err := s.Load("vol#1/a")
+	assert.NoError(t, err)
+	assert.Equal(t, &volumeState{
+		VolumeID:    "vol#1/a",
+		DeviceID:    3,
+		StagingPath: "/staging/vol_1",
+		Parameters:  map[string]string{capacityField: "1048576"},
+		Phase:       phaseStaging,
+		Intent:      intentConfigure,
+	}, loaded)
+
+	states, err := s.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []*volumeState{state1, state2}, states)
+
+	// temporary files are not left behind
+	files, err := ioutil.ReadDir(s.dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	assert.NoError(t, s.Delete("vol#1/a"))
+	assert.NoError(t, s.Delete("vol#1/a"))
+	states, err = s.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []*volumeState{state2}, states)
+}
+
+func TestStateStoreExpandDevice(t *testing.T) {
+	s := newStateStore(t.TempDir())
+	state := newVolumeState("vol_1", "/staging/vol_1", nil, false)
+	state.DeviceID = 1
+	state.Phase = phaseStaged
+	// the volume is migrated to zram0
+	expandDeviceID := 0
+	state.ExpandDeviceID = &expandDeviceID
+	assert.NoError(t, s.SetIntent(state, intentExpand))
+
+	loaded, err := s.Load("vol_1")
+	assert.NoError(t, err)
+	assert.NotNil(t, loaded.ExpandDeviceID)
+	assert.Equal(t, 0, loaded.expandDevice())
+
+	state.ExpandDeviceID = nil
+	assert.NoError(t, s.SetIntent(state, ""))
+	loaded, err = s.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Nil(t, loaded.ExpandDeviceID)
+}
+
+func TestStateStoreWithoutDir(t *testing.T) {
+	s := newStateStore("")
+	assert.NoError(t, s.Save(newVolumeState("vol_1", "/staging/vol_1", nil, false)))
+	state, err := s.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+	states, err := s.List()
+	assert.NoError(t, err)
+	assert.Empty(t, states)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// volumeCondition checks the staging mount and the zram device of a volume, volumePath is
+// where the volume is published and stagingPath may be empty if kubelet did not provide it.
+func (d *Driver) volumeCondition(volumeID, volumePath, stagingPath string, block bool) *csi.VolumeCondition {
+	var problems []string
+	var dev *ZRAMDevice
+	if vol, ok := d.volumes.Get(volumeID); ok {
+		dev, stagingPath, block = vol.dev, vol.stagingPath, vol.block
+		if vol.isReadOnly() {
+			problems = append(problems, fmt.Sprintf("filesystem was remounted read-only as zram device %s is close to its memory limit", dev.devPath))
+		}
+		problems = append(problems, vol.getProblems()...)
+	}
+
+	if block {
+		if dev == nil {
+			if published, err := NewZRAMDeviceFromDeviceFile(volumePath); err == nil {
+				dev = published
+			}
+		}
+	} else {
+		if stagingPath != "" {
+			staged, err := NewZRAMDeviceFromMountPath(stagingPath)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("staging path %s is no longer mounted from a zram device", stagingPath))
+			} else if dev == nil {
+				dev = staged
+			} else if staged.id != dev.id {
+				problems = append(problems, fmt.Sprintf("staging path %s is mounted from %s instead of %s", stagingPath, staged.devPath, dev.devPath))
+			}
+		}
+		if dev == nil {
+			if published, err := NewZRAMDeviceFromMountPath(volumePath); err == nil {
+				dev = published
+			}
+		}
+	}
+
+	if dev == nil {
+		problems = append(problems, fmt.Sprintf("no zram device found for %s", volumePath))
+	} else {
+		problems = append(problems, deviceProblems(dev)...)
+	}
+
+	if len(problems) == 0 {
+		return &csi.VolumeCondition{Abnormal: false, Message: fmt.Sprintf("zram device %s is healthy", dev.devPath)}
+	}
+	msg := strings.Join(problems, "; ")
+	klog.Warningf("volume %s is abnormal: %s", volumeID, msg)
+	return &csi.VolumeCondition{Abnormal: true, Message: msg}
+}
+
+// deviceProblems returns the problems of a zram device that make its volume unusable or lose data.
+func deviceProblems(dev *ZRAMDevice) []string {
+	if !dev.Exists() {
+		return []string{fmt.Sprintf("zram device %s was removed", dev.devPath)}
+	}
+	var problems []string
+	if _, err := os.Stat(dev.devPath); err != nil {
+		problems = append(problems, fmt.Sprintf("device node %s does not exist", dev.devPath))
+	}
+	if diskSize, err := dev.GetDiskSize(); err != nil {
+		klog.Warningf("failed to get disksize of %s: %v", dev.devPath, err)
+	} else if diskSize == 0 {
+		return append(problems, fmt.Sprintf("zram device %s was reset, its data is lost", dev.devPath))
+	}
+	if mmStat, err := dev.MMStat(); err != nil {
+		klog.Warningf("failed to get memory usage of %s: %v", dev.devPath, err)
+	} else if mmStat.MemLimit > 0 && mmStat.MemUsedTotal >= mmStat.MemLimit {
+		problems = append(problems, fmt.Sprintf("zram device %s reached its memory limit (%d of %d bytes used), writes will fail",
+			dev.devPath, mmStat.MemUsedTotal, mmStat.MemLimit))
+	}
+	if ioStat, err := dev.IOStat(); err != nil {
+		klog.Warningf("failed to get I/O statistics of %s: %v", dev.devPath, err)
+	} else if ioStat.FailedWrites > 0 {
+		problems = append(problems, fmt.Sprintf("zram device %s failed %d writes", dev.devPath, ioStat.FailedWrites))
+	}
+	return problems
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceProblems(t *testing.T) {
+	tests := []struct {
+		desc             string
+		attrs            map[string]string
+		removeDevNode    bool
+		expectedProblems []string
+	}{
+		{
+			desc: "healthy",
+			attrs: map[string]string{
+				"disksize": "1048576\n",
+				"mm_stat":  "8192 4096 12288 0 12288 0 0 0\n",
+				"io_stat":  "0 0 0 0\n",
+			},
+		},
+		{
+			desc: "reset",
+			attrs: map[string]string{
+				"disksize": "0\n",
+				"mm_stat":  "0 0 0 0 0 0 0 0\n",
+				"io_stat":  "0 0 0 0\n",
+			},
+			expectedProblems: []string{"zram device %s was reset, its data is lost"},
+		},
+		{
+			desc: "memory limit and failed writes",
+			attrs: map[string]string{
+				"disksize": "1048576\n",
+				"mm_stat":  "8192 4096 12288 12288 12288 0 0 0\n",
+				"io_stat":  "0 3 0 0\n",
+			},
+			expectedProblems: []string{
+				"zram device %s reached its memory limit (12288 of 12288 bytes used), writes will fail",
+				"zram device %s failed 3 writes",
+			},
+		},
+		{
+			desc: "device node removed",
+			attrs: map[string]string{
+				"disksize": "1048576\n",
+				"mm_stat":  "8192 4096 12288 0 12288 0 0 0\n",
+				"io_stat":  "0 0 0 0\n",
+			},
+			removeDevNode:    true,
+			expectedProblems: []string{"device node %s does not exist"},
+		},
+	}
+
+	for _, test := range tests {
+		dev := newFakeZRAMDevice(t, test.attrs)
+		dev.devPath = filepath.Join(t.TempDir(), "zram0")
+		if !test.removeDevNode {
+			assert.NoError(t, ioutil.WriteFile(dev.devPath, nil, 0644))
+		}
+		var expected []string
+		for _, p := range test.expectedProblems {
+			expected = append(expected, fmt.Sprintf(p, dev.devPath))
+		}
+		assert.Equal(t, expected, deviceProblems(dev), test.desc)
+	}
+}
+
+func TestVolumeCondition(t *testing.T) {
+	d := NewFakeDriver()
+	dev := newFakeZRAMDevice(t, map[string]string{
+		"disksize": "1048576\n",
+		"mm_stat":  "8192 4096 12288 0 12288 0 0 0\n",
+		"io_stat":  "0 0 0 0\n",
+	})
+	dev.devPath = filepath.Join(t.TempDir(), "zram0")
+	assert.NoError(t, ioutil.WriteFile(dev.devPath, nil, 0644))
+	d.volumes.Add(&stagedVolume{volumeID: "vol_1", dev: dev, opts: &volumeOptions{}, block: true})
+
+	condition := d.volumeCondition("vol_1", "/publish/vol_1", "", true)
+	assert.False(t, condition.Abnormal)
+
+	assert.NoError(t, os.RemoveAll(dev.sysPath))
+	condition = d.volumeCondition("vol_1", "/publish/vol_1", "", true)
+	assert.True(t, condition.Abnormal)
+	assert.Equal(t, "zram device "+dev.devPath+" was removed", condition.Message)
+
+	condition = d.volumeCondition("vol_2", "/publish/vol_2", "", true)
+	assert.True(t, condition.Abnormal)
+	assert.Equal(t, "no zram device found for /publish/vol_2", condition.Message)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// volumeLabelPrefix starts the filesystem labels of the volumes formatted by the driver
+const volumeLabelPrefix = "zc"
+
+// volumeLabel returns the filesystem label of a volume. It is derived from a hash of the
+// volume ID, as xfs labels are limited to 12 characters.
+func volumeLabel(volumeID string) string {
+	sum := sha256.Sum256([]byte(volumeID))
+	return volumeLabelPrefix + hex.EncodeToString(sum[:])[:10]
+}
+
+// isVolumeLabel returns true if label may have been set by volumeLabel.
+func isVolumeLabel(label string) bool {
+	return len(label) == len(volumeLabelPrefix)+10 && strings.HasPrefix(label, volumeLabelPrefix)
+}
+
+// discoveredDevice is a zram device holding a filesystem formatted by the driver.
+type discoveredDevice struct {
+	dev   *ZRAMDevice
+	label string
+	// stagingPath is where the device is mounted by kubelet, empty if it is not mounted
+	stagingPath string
+}
+
+// deviceInventory maps the filesystem labels of the volumes to their zram devices.
+type deviceInventory struct {
+	devices map[string]*discoveredDevice
+	mux     sync.RWMutex
+}
+
+func newDeviceInventory() *deviceInventory {
+	return &deviceInventory{
+		devices: make(map[string]*discoveredDevice),
+	}
+}
+
+func (di *deviceInventory) Get(label string) (*discoveredDevice, bool) {
+	di.mux.RLock()
+	defer di.mux.RUnlock()
+	found, ok := di.devices[label]
+	return found, ok
+}
+
+func (di *deviceInventory) Remove(label string) {
+	di.mux.Lock()
+	defer di.mux.Unlock()
+	delete(di.devices, label)
+}
+
+func (di *deviceInventory) Set(devices map[string]*discoveredDevice) {
+	di.mux.Lock()
+	defer di.mux.Unlock()
+	di.devices = devices
+}
+
+// scanDevices rebuilds the inventory from the zram devices of the node, their filesystem
+// labels and the mount table.
+func (d *Driver) scanDevices() {
+	devices, err := ListZRAMDevices()
+	if err != nil {
+		klog.Errorf("failed to list zram devices: %v", err)
+		return
+	}
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list mount points: %v", err)
+	}
+
+	discovered := make(map[string]*discoveredDevice)
+	for _, dev := range devices {
+		if diskSize, err := dev.GetDiskSize(); err != nil || diskSize == 0 {
+			continue
+		}
+		label, err := dev.GetFilesystemLabel()
+		if err != nil {
+			klog.Warningf("failed to get filesystem label of %s: %v", dev.devPath, err)
+			continue
+		}
+		if !isVolumeLabel(label) {
+			continue
+		}
+		found := &discoveredDevice{dev: dev, label: label}
+		for _, mp := range mountPoints {
+			if mp.Device == dev.devPath && filepath.Base(mp.Path) == "globalmount" {
+				found.stagingPath = mp.Path
+				break
+			}
+		}
+		klog.V(2).Infof("found %s labelled %s, staged on %q", dev.devPath, label, found.stagingPath)
+		discovered[label] = found
+	}
+	d.inventory.Set(discovered)
+}
+
+// lookupVolumeDevice returns the zram device holding the filesystem of a volume, scanning
+// the devices again if the inventory does not know it. A known device is only returned if it
+// still holds the filesystem of the volume, as the ids of removed devices are reused. It returns
+// nil if there is none.
+func (d *Driver) lookupVolumeDevice(volumeID string) *ZRAMDevice {
+	label := volumeLabel(volumeID)
+	if found, ok := d.inventory.Get(label); ok {
+		if found.dev.Exists() {
+			if current, err := found.dev.GetFilesystemLabel(); err == nil && current == label {
+				return found.dev
+			}
+		}
+		d.inventory.Remove(label)
+	}
+	d.scanDevices()
+	if found, ok := d.inventory.Get(label); ok {
+		return found.dev
+	}
+	return nil
+}
+
+// findVolumeDevice returns the zram device of a filesystem volume, from the registry, the mount
+// at the staging path, the state store or the filesystem labels. It returns nil if there is none.
+func (d *Driver) findVolumeDevice(volumeID, stagingPath string) *ZRAMDevice {
+	if vol, ok := d.volumes.Get(volumeID); ok && vol.dev.Exists() {
+		return vol.dev
+	}
+	if dev, err := NewZRAMDeviceFromMountPath(stagingPath); err == nil {
+		return dev
+	}
+	if state, err := d.state.Load(volumeID); err == nil && state != nil && state.DeviceID >= 0 {
+		dev, _ := NewZRAMDeviceFromId(state.DeviceID)
+		if dev.Exists() {
+			if label, err := dev.GetFilesystemLabel(); err == nil && label == volumeLabel(volumeID) {
+				return dev
+			}
+		}
+	}
+	return d.lookupVolumeDevice(volumeID)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mountutils "k8s.io/mount-utils"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"k8s.io/utils/mount"
+)
+
+func TestVolumeLabel(t *testing.T) {
+	label := volumeLabel("pvc-5ee4b1a4-8d7b-4c5b-a8e5-2e9f3c4d5e6f")
+	assert.Len(t, label, 12)
+	assert.True(t, isVolumeLabel(label))
+	assert.Equal(t, label, volumeLabel("pvc-5ee4b1a4-8d7b-4c5b-a8e5-2e9f3c4d5e6f"))
+	assert.NotEqual(t, label, volumeLabel("pvc-5ee4b1a4-8d7b-4c5b-a8e5-2e9f3c4d5e70"))
+
+	for _, l := range []string{"", "zc", "rootfs", "zc0123456789a"} {
+		assert.False(t, isVolumeLabel(l), l)
+	}
+}
+
+func TestMkfsArgs(t *testing.T) {
+	assert.Equal(t, []string{"-F", "-m0", "-L", "zc0123456789", "/dev/zram0"}, mkfsArgs("ext4", "zc0123456789", "/dev/zram0"))
+	assert.Equal(t, []string{"-L", "zc0123456789", "/dev/zram0"}, mkfsArgs("xfs", "zc0123456789", "/dev/zram0"))
+	assert.Equal(t, []string{"-F", "-m0", "/dev/zram0"}, mkfsArgs("ext4", "", "/dev/zram0"))
+	assert.Equal(t, []string{"/dev/zram0"}, mkfsArgs("vfat", "zc0123456789", "/dev/zram0"))
+}
+
+func TestGetFilesystemLabel(t *testing.T) {
+	tests := []struct {
+		desc          string
+		action        testingexec.FakeAction
+		expectedLabel string
+		expectedErr   bool
+	}{
+		{
+			desc: "labelled",
+			action: func() ([]byte, []byte, error) {
+				return []byte("zc0123456789\n"), nil, nil
+			},
+			expectedLabel: "zc0123456789",
+		},
+		{
+			desc: "no label",
+			action: func() ([]byte, []byte, error) {
+				return nil, nil, &testingexec.FakeExitError{Status: 2}
+			},
+		},
+		{
+			desc: "blkid failure",
+			action: func() ([]byte, []byte, error) {
+				return nil, nil, &testingexec.FakeExitError{Status: 4}
+			},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeCmd := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{test.action}}
+		fakeExec := &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd {
+				assert.Equal(t, "blkid", cmd)
+				assert.Equal(t, []string{"-p", "-s", "LABEL", "-o", "value", "/dev/zram0"}, args)
+				return testingexec.InitFakeCmd(fakeCmd, cmd, args...)
+			},
+		}}
+		dev := &ZRAMDevice{id: 0, devPath: "/dev/zram0", mounter: &mount.SafeFormatAndMount{Exec: fakeExec}}
+
+		label, err := dev.GetFilesystemLabel()
+		assert.Equal(t, test.expectedErr, err != nil, test.desc)
+		assert.Equal(t, test.expectedLabel, label, test.desc)
+	}
+}
+
+func TestLookupVolumeDevice(t *testing.T) {
+	labelled := func(label string) *mount.SafeFormatAndMount {
+		fakeCmd := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{
+			func() ([]byte, []byte, error) { return []byte(label + "\n"), nil, nil },
+		}}
+		return &mount.SafeFormatAndMount{Exec: &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return testingexec.InitFakeCmd(fakeCmd, cmd, args...) },
+		}}}
+	}
+	d := NewFakeDriver()
+	d.mounter = &mountutils.SafeFormatAndMount{Interface: mountutils.NewFakeMounter(nil)}
+
+	dev := newFakeZRAMDevice(t, nil)
+	dev.mounter = labelled(volumeLabel("vol_1"))
+	d.inventory.Set(map[string]*discoveredDevice{volumeLabel("vol_1"): {dev: dev, label: volumeLabel("vol_1")}})
+	assert.Equal(t, dev, d.lookupVolumeDevice("vol_1"))
+
+	// the id of the device was reused by another volume
+	dev.mounter = labelled(volumeLabel("vol_2"))
+	assert.Nil(t, d.lookupVolumeDevice("vol_1"))
+	_, ok := d.inventory.Get(volumeLabel("vol_1"))
+	assert.False(t, ok)
+}
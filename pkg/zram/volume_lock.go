@@ -23,34 +23,68 @@ import (
 )
 
 const (
-	volumeOperationAlreadyExistsFmt = "An operation with the given Volume ID %s already exists"
+	volumeOperationAlreadyExistsFmt   = "An operation with the given Volume ID %s already exists"
+	snapshotOperationAlreadyExistsFmt = "An operation with the given Snapshot ID %s already exists"
 )
 
+// snapshotLockKey is the lock of a snapshot in the volume locks. Volume IDs are PersistentVolume
+// names, which never contain a colon.
+func snapshotLockKey(snapshotID string) string {
+	return "snapshot:" + snapshotID
+}
+
 // VolumeLocks implements a map with atomic operations. It stores a set of all volume IDs
-// with an ongoing operation.
+// with an ongoing operation, and the filesystem labels of the volumes operated on without
+// knowing their ID.
 type volumeLocks struct {
-	locks sets.String
-	mux   sync.Mutex
+	locks  sets.String
+	labels sets.String
+	mux    sync.Mutex
 }
 
 func newVolumeLocks() *volumeLocks {
 	return &volumeLocks{
-		locks: sets.NewString(),
+		locks:  sets.NewString(),
+		labels: sets.NewString(),
 	}
 }
 
 // TryAcquire tries to acquire the lock for operating on volumeID and returns true if successful.
-// If another operation is already using volumeID, returns false.
+// If another operation is already using volumeID or its label, returns false.
 func (vl *volumeLocks) TryAcquire(volumeID string) bool {
 	vl.mux.Lock()
 	defer vl.mux.Unlock()
-	if vl.locks.Has(volumeID) {
+	if vl.locks.Has(volumeID) || vl.labels.Has(volumeLabel(volumeID)) {
 		return false
 	}
 	vl.locks.Insert(volumeID)
 	return true
 }
 
+// TryAcquireLabel tries to acquire the lock of the volume whose filesystem label is label and
+// returns true if successful. If an operation is already using the label or a volume ID it is
+// derived from, returns false.
+func (vl *volumeLocks) TryAcquireLabel(label string) bool {
+	vl.mux.Lock()
+	defer vl.mux.Unlock()
+	if vl.labels.Has(label) {
+		return false
+	}
+	for volumeID := range vl.locks {
+		if volumeLabel(volumeID) == label {
+			return false
+		}
+	}
+	vl.labels.Insert(label)
+	return true
+}
+
+func (vl *volumeLocks) ReleaseLabel(label string) {
+	vl.mux.Lock()
+	defer vl.mux.Unlock()
+	vl.labels.Delete(label)
+}
+
 func (vl *volumeLocks) Release(volumeID string) {
 	vl.mux.Lock()
 	defer vl.mux.Unlock()
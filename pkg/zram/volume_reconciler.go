@@ -0,0 +1,166 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// reconcileVolumes checks the staged volumes that no operation is in progress on: the staging
+// mount must still be the filesystem of the expected zram device, every publish target a
+// bind mount of it and the disksize of the device the requested capacity. Lost or corrupted
+// publish mounts are bound again, the other problems are logged and reported in the volume
+// condition.
+func (d *Driver) reconcileVolumes() {
+	for _, vol := range d.volumes.List() {
+		if acquired := d.volumeLocks.TryAcquire(vol.volumeID); !acquired {
+			continue
+		}
+		if _, ok := d.volumes.Get(vol.volumeID); ok {
+			problems := d.reconcileVolume(vol)
+			for _, problem := range problems {
+				klog.Errorf("reconcile: volume %s: %s", vol.volumeID, problem)
+			}
+			vol.setProblems(problems)
+		}
+		d.volumeLocks.Release(vol.volumeID)
+	}
+}
+
+// reconcileVolume repairs what it can and returns the problems of the volume not reported by
+// volumeCondition itself.
+func (d *Driver) reconcileVolume(vol *stagedVolume) []string {
+	dev := vol.dev
+	if !dev.Exists() {
+		klog.Errorf("reconcile: zram device %s of volume %s was removed", dev.devPath, vol.volumeID)
+		return nil
+	}
+	diskSize, err := dev.GetDiskSize()
+	if err != nil {
+		klog.Warningf("reconcile: failed to get disksize of %s: %v", dev.devPath, err)
+		return nil
+	}
+	if diskSize == 0 {
+		klog.Errorf("reconcile: zram device %s of volume %s was reset", dev.devPath, vol.volumeID)
+		return nil
+	}
+	var problems []string
+	if expected := pageAlign(vol.capacity); vol.capacity > 0 && diskSize != expected {
+		problems = append(problems, fmt.Sprintf("zram device %s has a disksize of %d bytes instead of %d", dev.devPath, diskSize, expected))
+	}
+
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		klog.Warningf("reconcile: failed to list mount points: %v", err)
+		return problems
+	}
+	source := dev.devPath
+	if !vol.block {
+		staged, ok := findMountPoint(mountPoints, vol.stagingPath)
+		if !ok || staged.Device != dev.devPath {
+			// reported by volumeCondition, bind mounts of the staging path would not be the volume
+			klog.Errorf("reconcile: staging path %s of volume %s is not mounted from %s, publish targets are not repaired",
+				vol.stagingPath, vol.volumeID, dev.devPath)
+			return problems
+		}
+		source = vol.stagingPath
+	}
+
+	for target, readOnly := range vol.publishTargets() {
+		if problem := d.reconcileTarget(vol, source, target, readOnly, mountPoints); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// deviceOfFile returns the zram device of a device node, a variable to be replaced in tests.
+var deviceOfFile = NewZRAMDeviceFromDeviceFile
+
+// reconcileTarget binds the volume again on a publish target whose mount was lost or is
+// corrupted, and returns a problem if the target cannot be repaired. Targets are bound
+// read-only while the memory watchdog keeps the volume read-only.
+func (d *Driver) reconcileTarget(vol *stagedVolume, source, target string, readOnly bool, mountPoints []mount.MountPoint) string {
+	mp, mounted := findMountPoint(mountPoints, target)
+	if mounted && !vol.block && mp.Device != vol.dev.devPath {
+		return fmt.Sprintf("publish target %s is mounted from %s instead of %s", target, mp.Device, vol.dev.devPath)
+	}
+	_, err := os.Stat(target)
+	switch {
+	case mounted && err == nil:
+		if vol.block {
+			return blockTargetProblem(vol, target)
+		}
+		return ""
+	case mounted && mount.IsCorruptedMnt(err):
+		klog.Warningf("reconcile: publish target %s of volume %s is corrupted, unmounting it", target, vol.volumeID)
+		if err := d.mounter.Unmount(target); err != nil {
+			return fmt.Sprintf("failed to unmount corrupted publish target %s: %v", target, err)
+		}
+	case os.IsNotExist(err):
+		return fmt.Sprintf("publish target %s no longer exists", target)
+	case err != nil:
+		return fmt.Sprintf("failed to check publish target %s: %v", target, err)
+	}
+
+	mountOptions := []string{"bind"}
+	watchdogReadOnly := !readOnly && vol.isReadOnly()
+	if readOnly || watchdogReadOnly {
+		mountOptions = append(mountOptions, "ro")
+	}
+	if err := d.mounter.Mount(source, target, "", mountOptions); err != nil {
+		return fmt.Sprintf("failed to bind %s on publish target %s again: %v", source, target, err)
+	}
+	if watchdogReadOnly {
+		vol.addReadOnlyTarget(target)
+	}
+	klog.Warningf("reconcile: bound %s on publish target %s of volume %s again", source, target, vol.volumeID)
+	return ""
+}
+
+// blockTargetProblem checks that the device node bound on the target of a raw block volume is
+// the zram device of the volume. The mount table reports devtmpfs as the source of such bind
+// mounts, so the device numbers are compared instead.
+func blockTargetProblem(vol *stagedVolume, target string) string {
+	dev, err := deviceOfFile(target)
+	if err != nil {
+		return fmt.Sprintf("failed to get device of publish target %s: %v", target, err)
+	}
+	if dev.id != vol.dev.id {
+		return fmt.Sprintf("publish target %s is bound to %s instead of %s", target, dev.devPath, vol.dev.devPath)
+	}
+	return ""
+}
+
+func findMountPoint(mountPoints []mount.MountPoint, path string) (mount.MountPoint, bool) {
+	for _, mp := range mountPoints {
+		if mp.Path == path {
+			return mp, true
+		}
+	}
+	return mount.MountPoint{}, false
+}
+
+// pageAlign rounds size up to the page size, as the kernel does for disksize.
+func pageAlign(size int64) int64 {
+	pageSize := int64(os.Getpagesize())
+	return (size + pageSize - 1) / pageSize * pageSize
+}
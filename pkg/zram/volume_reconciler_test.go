@@ -0,0 +1,168 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mount "k8s.io/mount-utils"
+)
+
+func TestReconcileVolumes(t *testing.T) {
+	d := NewFakeDriver()
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": "1048576\n"})
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "globalmount")
+	healthy := filepath.Join(dir, "pod_1")
+	lost := filepath.Join(dir, "pod_2")
+	removed := filepath.Join(dir, "pod_3")
+	replaced := filepath.Join(dir, "pod_4")
+	for _, path := range []string{staging, healthy, lost, replaced} {
+		assert.NoError(t, os.MkdirAll(path, 0750))
+	}
+
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: dev.devPath, Path: staging},
+		{Device: dev.devPath, Path: healthy},
+		{Device: "/dev/zram1", Path: replaced},
+	})
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	vol := &stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: staging, opts: &volumeOptions{}, capacity: 1048576}
+	vol.addTarget(healthy, false)
+	vol.addTarget(lost, true)
+	vol.addTarget(removed, false)
+	vol.addTarget(replaced, false)
+	d.volumes.Add(vol)
+
+	d.reconcileVolumes()
+	assert.Equal(t, mount.MountPoint{Device: dev.devPath, Path: lost, Opts: []string{"bind", "ro"}}, fakeMounter.MountPoints[3])
+	assert.Len(t, fakeMounter.MountPoints, 4)
+	assert.ElementsMatch(t, []string{
+		"publish target " + removed + " no longer exists",
+		"publish target " + replaced + " is mounted from /dev/zram1 instead of /dev/zram0",
+	}, vol.getProblems())
+
+	// the volume is busy
+	vol.setProblems(nil)
+	assert.True(t, d.volumeLocks.TryAcquire("vol_1"))
+	d.reconcileVolumes()
+	assert.Empty(t, vol.getProblems())
+	d.volumeLocks.Release("vol_1")
+
+	// the staging mount was lost, its bind mounts are not restored
+	vol.removeTarget(removed)
+	vol.removeTarget(replaced)
+	vol.capacity = 2097152
+	fakeMounter.MountPoints = nil
+	d.reconcileVolumes()
+	assert.Empty(t, fakeMounter.MountPoints)
+	assert.Equal(t, []string{"zram device /dev/zram0 has a disksize of 1048576 bytes instead of 2097152"}, vol.getProblems())
+
+	condition := d.volumeCondition("vol_1", lost, staging, false)
+	assert.True(t, condition.Abnormal)
+	assert.Contains(t, condition.Message, "disksize of 1048576 bytes")
+}
+
+func TestReconcileBlockVolume(t *testing.T) {
+	d := NewFakeDriver()
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": "1048576\n"})
+	dir := t.TempDir()
+	healthy := filepath.Join(dir, "pod_1")
+	lost := filepath.Join(dir, "pod_2")
+	replaced := filepath.Join(dir, "pod_3")
+	for _, path := range []string{healthy, lost, replaced} {
+		assert.NoError(t, ioutil.WriteFile(path, nil, 0640))
+	}
+	defer func(f func(string) (*ZRAMDevice, error)) { deviceOfFile = f }(deviceOfFile)
+	deviceOfFile = func(path string) (*ZRAMDevice, error) {
+		if path == replaced {
+			return NewZRAMDeviceFromId(1)
+		}
+		return dev, nil
+	}
+
+	// bind mounts of device nodes are reported with the source of /dev
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "udev", Path: healthy},
+		{Device: "udev", Path: replaced},
+	})
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	vol := &stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: filepath.Join(dir, "staging"), opts: &volumeOptions{},
+		block: true, capacity: 1048576}
+	vol.addTarget(healthy, false)
+	vol.addTarget(lost, false)
+	vol.addTarget(replaced, false)
+	d.volumes.Add(vol)
+
+	d.reconcileVolumes()
+	assert.Len(t, fakeMounter.MountPoints, 3)
+	assert.Equal(t, mount.MountPoint{Device: dev.devPath, Path: lost, Opts: []string{"bind"}}, fakeMounter.MountPoints[2])
+	assert.Equal(t, []string{"publish target " + replaced + " is bound to /dev/zram1 instead of /dev/zram0"}, vol.getProblems())
+}
+
+func TestReconcileReadOnlyVolume(t *testing.T) {
+	d := NewFakeDriver()
+	dev := newFakeZRAMDevice(t, map[string]string{"disksize": "1048576\n"})
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "globalmount")
+	lost := filepath.Join(dir, "pod_1")
+	for _, path := range []string{staging, lost} {
+		assert.NoError(t, os.MkdirAll(path, 0750))
+	}
+	fakeMounter := mount.NewFakeMounter([]mount.MountPoint{{Device: dev.devPath, Path: staging}})
+	d.mounter = &mount.SafeFormatAndMount{Interface: fakeMounter}
+	vol := &stagedVolume{volumeID: "vol_1", dev: dev, stagingPath: staging, opts: &volumeOptions{}, capacity: 1048576}
+	vol.addTarget(lost, false)
+	// the memory watchdog remounted the volume read-only
+	vol.setReadOnly(true, nil)
+	d.volumes.Add(vol)
+
+	d.reconcileVolumes()
+	assert.Equal(t, mount.MountPoint{Device: dev.devPath, Path: lost, Opts: []string{"bind", "ro"}}, fakeMounter.MountPoints[1])
+	_, targets := vol.readOnlyState()
+	assert.Equal(t, []string{lost}, targets)
+}
+
+func TestRecordPublishTarget(t *testing.T) {
+	d := NewFakeDriver()
+	d.state = newStateStore(t.TempDir())
+	state := newVolumeState("vol_1", "/staging/vol_1", nil, false)
+	state.Phase = phaseStaged
+	assert.NoError(t, d.state.Save(state))
+	vol := &stagedVolume{volumeID: "vol_1", stagingPath: "/staging/vol_1", opts: &volumeOptions{}}
+	d.volumes.Add(vol)
+
+	assert.NoError(t, d.recordPublishTarget("vol_1", "/publish/pod_1", false, true))
+	assert.NoError(t, d.recordPublishTarget("vol_1", "/publish/pod_2", true, true))
+	assert.NoError(t, d.recordPublishTarget("vol_1", "/publish/pod_1", false, false))
+
+	expected := map[string]bool{"/publish/pod_2": true}
+	assert.Equal(t, expected, vol.publishTargets())
+	loaded, err := d.state.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, loaded.PublishTargets)
+
+	// volumes unknown to the driver are not recorded
+	assert.NoError(t, d.recordPublishTarget("vol_2", "/publish/pod_1", false, true))
+	loaded, err = d.state.Load("vol_2")
+	assert.NoError(t, err)
+	assert.Nil(t, loaded)
+}
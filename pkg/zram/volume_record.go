@@ -0,0 +1,184 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// volumeRecord keeps what the node learned about a volume that its immutable volume context
+// does not tell. Unlike the state store and the generation markers, records survive the
+// unstaging of the volume and are only deleted with the volume.
+type volumeRecord struct {
+	VolumeID string `json:"volumeID"`
+	// Capacity is the disksize the volume was expanded to, 0 if it was never expanded
+	Capacity int64 `json:"capacity,omitempty"`
+	// Populated is set once the volume was filled from the content source of its volume context
+	Populated bool `json:"populated,omitempty"`
+	// BackingFiles are the backing files created for the volume, removed once they are found
+	// with no loop device attached
+	BackingFiles []string `json:"backingFiles,omitempty"`
+}
+
+// recordStore keeps one record per volume in a directory, records are replaced atomically.
+// A store without directory does not record anything.
+type recordStore struct {
+	dir string
+}
+
+func newRecordStore(dir string) *recordStore {
+	return &recordStore{dir: dir}
+}
+
+func (s *recordStore) path(volumeID string) string {
+	return filepath.Join(s.dir, url.PathEscape(volumeID)+".json")
+}
+
+func (s *recordStore) Save(record *volumeRecord) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(record.VolumeID), data)
+}
+
+// Load returns the record of the volume, nil if there is none.
+func (s *recordStore) Load(volumeID string) (*volumeRecord, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.path(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	record := &volumeRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("invalid record of volume %s: %v", volumeID, err)
+	}
+	return record, nil
+}
+
+// List returns all records, those that cannot be read are skipped.
+func (s *recordStore) List() ([]*volumeRecord, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var records []*volumeRecord
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Warningf("failed to read %s: %v", path, err)
+			continue
+		}
+		record := &volumeRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			klog.Warningf("invalid volume record %s: %v", path, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (s *recordStore) Delete(volumeID string) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.Remove(s.path(volumeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// updateRecord loads the record of a volume, applies update to it and saves it.
+func (d *Driver) updateRecord(volumeID string, update func(record *volumeRecord)) error {
+	record, err := d.records.Load(volumeID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		record = &volumeRecord{VolumeID: volumeID}
+	}
+	update(record)
+	return d.records.Save(record)
+}
+
+// recordCapacity records the capacity a volume is expanded to, so that it keeps it when it is
+// staged again.
+func (d *Driver) recordCapacity(volumeID string, capacity int64) error {
+	if err := d.updateRecord(volumeID, func(record *volumeRecord) {
+		if capacity > record.Capacity {
+			record.Capacity = capacity
+		}
+	}); err != nil {
+		return status.Errorf(codes.Internal, "failed to record capacity of volume %s: %v", volumeID, err)
+	}
+	return nil
+}
+
+// recordPopulated records that a volume was filled from its content source, which only applies
+// to its first population as the source may be gone by the time the volume is staged again. The
+// volume is populated again on its next stage if that fails.
+func (d *Driver) recordPopulated(volumeID string) {
+	if err := d.updateRecord(volumeID, func(record *volumeRecord) {
+		record.Populated = true
+	}); err != nil {
+		klog.Warningf("failed to record population of volume %s: %v", volumeID, err)
+	}
+}
+
+// stagingContext returns the volume context to stage a volume with: its capacity is replaced by
+// the capacity the volume was expanded to, as the volume context keeps the initial one.
+func (d *Driver) stagingContext(volumeID string, context map[string]string) (map[string]string, error) {
+	record, err := d.records.Load(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get record of volume %s: %v", volumeID, err)
+	}
+	if record == nil || record.Capacity == 0 {
+		return context, nil
+	}
+	if capacity, err := volumeCapacity(context); err == nil && capacity >= record.Capacity {
+		return context, nil
+	}
+	klog.V(2).Infof("volume %s was expanded to %d bytes", volumeID, record.Capacity)
+	expanded := make(map[string]string, len(context)+1)
+	for k, v := range context {
+		expanded[k] = v
+	}
+	expanded[capacityField] = strconv.FormatInt(record.Capacity, 10)
+	return expanded, nil
+}
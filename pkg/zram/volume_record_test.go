@@ -0,0 +1,76 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordStore(t *testing.T) {
+	s := newRecordStore(t.TempDir())
+	record, err := s.Load("vol#1/a")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	assert.NoError(t, s.Save(&volumeRecord{VolumeID: "vol#1/a", Capacity: 2097152}))
+	record, err = s.Load("vol#1/a")
+	assert.NoError(t, err)
+	assert.Equal(t, &volumeRecord{VolumeID: "vol#1/a", Capacity: 2097152}, record)
+
+	assert.NoError(t, s.Delete("vol#1/a"))
+	assert.NoError(t, s.Delete("vol#1/a"))
+	record, err = s.Load("vol#1/a")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	// a store without directory records nothing
+	s = newRecordStore("")
+	assert.NoError(t, s.Save(&volumeRecord{VolumeID: "vol_1", Capacity: 1}))
+	record, err = s.Load("vol_1")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestStagingContext(t *testing.T) {
+	d := NewFakeDriver()
+	d.records = newRecordStore(t.TempDir())
+	volumeContext := map[string]string{capacityField: "1048576", "memLimit": "50%"}
+
+	// never expanded
+	stagingContext, err := d.stagingContext("vol_1", volumeContext)
+	assert.NoError(t, err)
+	assert.Equal(t, volumeContext, stagingContext)
+
+	assert.NoError(t, d.recordCapacity("vol_1", 2097152))
+	// a smaller expansion retried does not shrink the record
+	assert.NoError(t, d.recordCapacity("vol_1", 1572864))
+	stagingContext, err = d.stagingContext("vol_1", volumeContext)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{capacityField: "2097152", "memLimit": "50%"}, stagingContext)
+	assert.Equal(t, "1048576", volumeContext[capacityField])
+
+	// the record is deleted with the volume
+	_, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol_1"})
+	assert.NoError(t, err)
+	stagingContext, err = d.stagingContext("vol_1", volumeContext)
+	assert.NoError(t, err)
+	assert.Equal(t, volumeContext, stagingContext)
+}
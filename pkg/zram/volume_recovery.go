@@ -0,0 +1,91 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"k8s.io/klog/v2"
+)
+
+// recoverVolumes goes through the state store on start. Staged volumes are registered again,
+// an interrupted stage is rolled back and an interrupted unstage is completed.
+func (d *Driver) recoverVolumes() {
+	states, err := d.state.List()
+	if err != nil {
+		klog.Errorf("failed to read volume states: %v", err)
+		return
+	}
+	for _, state := range states {
+		switch state.Phase {
+		case phaseStaged:
+			if state.Intent == intentExpand {
+				klog.Warningf("expansion of volume %s was interrupted, rolling it back", state.VolumeID)
+				newDev, _ := NewZRAMDeviceFromId(state.expandDevice())
+				if err := d.rollbackExpansion(state, newDev, state.MountOptions); err != nil {
+					klog.Errorf("failed to roll back expansion of volume %s: %v", state.VolumeID, err)
+				}
+			}
+			d.restoreStagedVolume(state)
+		case phaseStaging:
+			klog.Warningf("staging of volume %s on %s was interrupted at %q, rolling it back", state.VolumeID, state.StagingPath, state.Intent)
+			if err := d.teardownVolume(state); err != nil {
+				klog.Errorf("failed to roll back staging of volume %s: %v", state.VolumeID, err)
+			}
+		case phaseUnstaging:
+			klog.Warningf("unstaging of volume %s from %s was interrupted at %q, completing it", state.VolumeID, state.StagingPath, state.Intent)
+			if err := d.teardownVolume(state); err != nil {
+				klog.Errorf("failed to unstage volume %s: %v", state.VolumeID, err)
+			} else if err := d.generations.Delete(state.VolumeID); err != nil {
+				klog.Errorf("failed to delete generation of volume %s: %v", state.VolumeID, err)
+			}
+		default:
+			klog.Warningf("ignoring volume %s in unknown phase %q", state.VolumeID, state.Phase)
+		}
+	}
+}
+
+// restoreStagedVolume registers a volume staged before the driver started, its budget is
+// restored by restoreBudget.
+func (d *Driver) restoreStagedVolume(state *volumeState) {
+	dev, _ := NewZRAMDeviceFromId(state.DeviceID)
+	if found, ok := d.inventory.Get(volumeLabel(state.VolumeID)); ok && !state.Block && found.dev.id != state.DeviceID {
+		klog.Warningf("volume %s is recorded on %s but its filesystem is on %s", state.VolumeID, dev.devPath, found.dev.devPath)
+		dev = found.dev
+		state.DeviceID = dev.id
+		if err := d.state.Save(state); err != nil {
+			klog.Errorf("failed to record state of volume %s: %v", state.VolumeID, err)
+		}
+	}
+	if state.DeviceID < 0 || !dev.Exists() {
+		klog.Warningf("zram device of volume %s no longer exists, forgetting the volume", state.VolumeID)
+		if err := d.state.Delete(state.VolumeID); err != nil {
+			klog.Errorf("failed to delete state of volume %s: %v", state.VolumeID, err)
+		}
+		return
+	}
+	if !state.Block {
+		d.thawStagedFilesystem(state.VolumeID, state.StagingPath, dev)
+	}
+	opts, err := parseVolumeOptions(state.Parameters)
+	if err != nil {
+		klog.Warningf("invalid parameters of volume %s, background tasks are disabled: %v", state.VolumeID, err)
+		opts = &volumeOptions{}
+	}
+	capacity, _ := volumeCapacity(state.Parameters)
+	klog.V(2).Infof("restored volume %s staged on %s with %s", state.VolumeID, state.StagingPath, dev.devPath)
+	d.registerVolume(&stagedVolume{volumeID: state.VolumeID, dev: dev, stagingPath: state.StagingPath, opts: opts, block: state.Block,
+		capacity: capacity, mountOptions: state.MountOptions, targets: state.PublishTargets, trimmedBytes: state.TrimmedBytes})
+}
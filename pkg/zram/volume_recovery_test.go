@@ -0,0 +1,61 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverVolumes(t *testing.T) {
+	d := NewFakeDriver()
+	d.state = newStateStore(t.TempDir())
+
+	// interrupted before the device was added
+	staging := newVolumeState("vol_1", "/staging/vol_1", nil, false)
+	staging.Intent = intentHotAdd
+	assert.NoError(t, d.state.Save(staging))
+	assert.NoError(t, d.budget.Reserve(staging.StagingPath, 1024))
+
+	// interrupted after the device of a block volume was removed
+	blockStagingPath := t.TempDir()
+	assert.NoError(t, writeBlockDeviceFile(blockStagingPath, "/dev/zram1000"))
+	unstaging := newVolumeState("vol_2", blockStagingPath, nil, true)
+	unstaging.DeviceID = 1000
+	unstaging.Phase = phaseUnstaging
+	unstaging.Intent = intentHotRemove
+	assert.NoError(t, d.state.Save(unstaging))
+
+	// staged, but its device is gone
+	staged := newVolumeState("vol_3", "/staging/vol_3", nil, false)
+	staged.DeviceID = 1001
+	staged.Phase = phaseStaged
+	assert.NoError(t, d.state.Save(staged))
+
+	d.recoverVolumes()
+
+	states, err := d.state.List()
+	assert.NoError(t, err)
+	assert.Empty(t, states)
+	assert.Empty(t, d.volumes.List())
+	assert.Empty(t, d.budget.reservations)
+	_, err = os.Stat(filepath.Join(blockStagingPath, blockDeviceFile))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// registerVolume records a staged volume and starts its background tasks. A volume registered
+// again, e.g. after an expansion, keeps the counters and the read-only state of its previous
+// registration.
+func (d *Driver) registerVolume(vol *stagedVolume) {
+	d.ensureGeneration(vol.volumeID)
+	if prev, ok := d.volumes.Get(vol.volumeID); ok && prev != vol {
+		atomic.StoreUint64(&vol.trimmedBytes, atomic.LoadUint64(&prev.trimmedBytes))
+		vol.setReadOnly(prev.readOnlyState())
+	}
+	d.volumes.Add(vol)
+	d.startVolumeTasks(vol)
+}
+
+// stagedVolume describes a volume staged on this node.
+type stagedVolume struct {
+	volumeID    string
+	dev         *ZRAMDevice
+	stagingPath string
+	opts        *volumeOptions
+	// block is set for raw block volumes, which have no filesystem mounted at stagingPath
+	block bool
+	// capacity is the disksize requested for the volume, 0 if unknown
+	capacity int64
+	// mountOptions are the options of the filesystem mounted at stagingPath
+	mountOptions []string
+	// trimmedBytes is the number of bytes discarded by fstrim since the volume was staged,
+	// accessed atomically and kept in the state store across restarts.
+	trimmedBytes uint64
+	// targets maps the paths the volume is published on to whether they are read-only, and
+	// problems lists what the reconciler found broken and could not repair.
+	targets  map[string]bool
+	problems []string
+	// readOnly is set while the memory watchdog keeps the filesystem read-only and
+	// readOnlyTargets are the published targets it remounted.
+	readOnly        bool
+	readOnlyTargets []string
+	// mux guards targets, problems and the read-only state
+	mux sync.Mutex
+}
+
+// addTarget records a path the volume is published on.
+func (vol *stagedVolume) addTarget(target string, readOnly bool) {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	if vol.targets == nil {
+		vol.targets = make(map[string]bool)
+	}
+	vol.targets[target] = readOnly
+}
+
+func (vol *stagedVolume) removeTarget(target string) {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	delete(vol.targets, target)
+	for i, t := range vol.readOnlyTargets {
+		if t == target {
+			vol.readOnlyTargets = append(vol.readOnlyTargets[:i:i], vol.readOnlyTargets[i+1:]...)
+			break
+		}
+	}
+}
+
+// publishTargets returns a copy of the paths the volume is published on.
+func (vol *stagedVolume) publishTargets() map[string]bool {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	targets := make(map[string]bool, len(vol.targets))
+	for target, readOnly := range vol.targets {
+		targets[target] = readOnly
+	}
+	return targets
+}
+
+func (vol *stagedVolume) setProblems(problems []string) {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	vol.problems = problems
+}
+
+func (vol *stagedVolume) getProblems() []string {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	return vol.problems
+}
+
+// isReadOnly returns true if the memory watchdog remounted the volume read-only.
+func (vol *stagedVolume) isReadOnly() bool {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	return vol.readOnly
+}
+
+// readOnlyState returns whether the memory watchdog remounted the volume read-only and the
+// published targets it remounted.
+func (vol *stagedVolume) readOnlyState() (bool, []string) {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	return vol.readOnly, append([]string(nil), vol.readOnlyTargets...)
+}
+
+// addReadOnlyTarget records a target bound read-only while the memory watchdog keeps the
+// volume read-only, so that it is remounted read-write with the volume.
+func (vol *stagedVolume) addReadOnlyTarget(target string) {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	if vol.readOnly {
+		vol.readOnlyTargets = append(vol.readOnlyTargets, target)
+	}
+}
+
+func (vol *stagedVolume) setReadOnly(readOnly bool, targets []string) {
+	vol.mux.Lock()
+	defer vol.mux.Unlock()
+	vol.readOnly = readOnly
+	vol.readOnlyTargets = targets
+}
+
+// volumeRegistry keeps track of the volumes staged on this node.
+type volumeRegistry struct {
+	volumes map[string]*stagedVolume
+	mux     sync.RWMutex
+}
+
+func newVolumeRegistry() *volumeRegistry {
+	return &volumeRegistry{
+		volumes: make(map[string]*stagedVolume),
+	}
+}
+
+func (vr *volumeRegistry) Add(vol *stagedVolume) {
+	vr.mux.Lock()
+	defer vr.mux.Unlock()
+	vr.volumes[vol.volumeID] = vol
+}
+
+func (vr *volumeRegistry) Get(volumeID string) (*stagedVolume, bool) {
+	vr.mux.RLock()
+	defer vr.mux.RUnlock()
+	vol, ok := vr.volumes[volumeID]
+	return vol, ok
+}
+
+func (vr *volumeRegistry) Remove(volumeID string) {
+	vr.mux.Lock()
+	defer vr.mux.Unlock()
+	delete(vr.volumes, volumeID)
+}
+
+// List returns the staged volumes sorted by volume ID.
+func (vr *volumeRegistry) List() []*stagedVolume {
+	vr.mux.RLock()
+	defer vr.mux.RUnlock()
+	volumes := make([]*stagedVolume, 0, len(vr.volumes))
+	for _, vol := range vr.volumes {
+		volumes = append(volumes, vol)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].volumeID < volumes[j].volumeID })
+	return volumes
+}
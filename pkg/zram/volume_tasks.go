@@ -0,0 +1,120 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// startVolumeTasks starts the background tasks requested by the volume options,
+// unless they are already running for the volume.
+func (d *Driver) startVolumeTasks(vol *stagedVolume) {
+	volumeID, dev, opts := vol.volumeID, vol.dev, vol.opts
+	if d.volumeTasks.Has(volumeID) {
+		return
+	}
+	if opts.writebackInterval > 0 {
+		name := fmt.Sprintf("writeback(%s, %s)", volumeID, dev.devPath)
+		d.volumeTasks.Add(volumeID, startPeriodicTask(name, opts.writebackInterval, func() {
+			writebackPages(dev, opts)
+		}))
+	}
+	if opts.recompInterval > 0 {
+		name := fmt.Sprintf("recompress(%s, %s)", volumeID, dev.devPath)
+		d.volumeTasks.Add(volumeID, startPeriodicTask(name, opts.recompInterval, func() {
+			recompressPages(dev, opts)
+		}))
+	}
+	if opts.fstrimInterval > 0 {
+		name := fmt.Sprintf("fstrim(%s, %s)", volumeID, vol.stagingPath)
+		d.volumeTasks.Add(volumeID, startPeriodicTask(name, opts.fstrimInterval, func() {
+			trimVolume(vol)
+			d.recordTrimmedBytes(vol)
+		}))
+	}
+}
+
+// periodicTask runs a function at a fixed interval on its own goroutine until stopped.
+type periodicTask struct {
+	name   string
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// startPeriodicTask calls fn right away and then every interval.
+func startPeriodicTask(name string, interval time.Duration, fn func()) *periodicTask {
+	t := &periodicTask{
+		name:   name,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	klog.V(2).Infof("starting task %s with interval %v", name, interval)
+	go func() {
+		defer close(t.doneCh)
+		wait.Until(fn, interval, t.stopCh)
+	}()
+	return t
+}
+
+// Stop stops the task and waits for a running iteration to finish.
+func (t *periodicTask) Stop() {
+	close(t.stopCh)
+	<-t.doneCh
+	klog.V(2).Infof("stopped task %s", t.name)
+}
+
+// volumeTasks keeps the background tasks started for each staged volume.
+type volumeTasks struct {
+	tasks map[string][]*periodicTask
+	mux   sync.Mutex
+}
+
+func newVolumeTasks() *volumeTasks {
+	return &volumeTasks{
+		tasks: make(map[string][]*periodicTask),
+	}
+}
+
+// Has returns true if there are tasks running for volumeID.
+func (vt *volumeTasks) Has(volumeID string) bool {
+	vt.mux.Lock()
+	defer vt.mux.Unlock()
+	return len(vt.tasks[volumeID]) > 0
+}
+
+func (vt *volumeTasks) Add(volumeID string, t *periodicTask) {
+	vt.mux.Lock()
+	defer vt.mux.Unlock()
+	vt.tasks[volumeID] = append(vt.tasks[volumeID], t)
+}
+
+// Stop stops all tasks of volumeID.
+func (vt *volumeTasks) Stop(volumeID string) {
+	vt.mux.Lock()
+	tasks := vt.tasks[volumeID]
+	delete(vt.tasks, volumeID)
+	vt.mux.Unlock()
+
+	for _, t := range tasks {
+		t.Stop()
+	}
+}
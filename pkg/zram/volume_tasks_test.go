@@ -0,0 +1,46 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeTasks(t *testing.T) {
+	vt := newVolumeTasks()
+	assert.False(t, vt.Has("vol_1"))
+
+	var count int32
+	vt.Add("vol_1", startPeriodicTask("test", 10*time.Millisecond, func() {
+		atomic.AddInt32(&count, 1)
+	}))
+	assert.True(t, vt.Has("vol_1"))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&count) >= 2 }, time.Second, 5*time.Millisecond)
+
+	vt.Stop("vol_1")
+	assert.False(t, vt.Has("vol_1"))
+	stopped := atomic.LoadInt32(&count)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&count))
+
+	// stopping a volume without tasks is a no-op
+	vt.Stop("vol_2")
+}
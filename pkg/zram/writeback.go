@@ -0,0 +1,52 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// writebackPages writes the pages selected by the volume writeback mode to the backing device.
+//
+// Without an idle age, pages are marked idle after each writeback, so the next run writes
+// back the pages that have not been accessed for a whole interval.
+func writebackPages(dev *ZRAMDevice, opts *volumeOptions) {
+	if opts.writebackMode != writebackModeHuge && opts.writebackIdleAge > 0 {
+		if err := dev.MarkIdle(strconv.FormatInt(int64(opts.writebackIdleAge.Seconds()), 10)); err != nil {
+			klog.Warningf("failed to mark pages idle on %s: %v", dev.devPath, err)
+			return
+		}
+	}
+	if err := dev.Writeback(opts.writebackMode); err != nil {
+		klog.Warningf("failed to write back %s pages of %s: %v", opts.writebackMode, dev.devPath, err)
+	} else {
+		klog.V(4).Infof("wrote back %s pages of %s", opts.writebackMode, dev.devPath)
+	}
+	if opts.writebackMode != writebackModeHuge && opts.writebackIdleAge == 0 {
+		if err := dev.MarkIdle("all"); err != nil {
+			klog.Warningf("failed to mark pages idle on %s: %v", dev.devPath, err)
+		}
+	}
+}
+
+// writebackMarksIdle returns true if the periodic writeback of the volume marks pages idle,
+// which it does for every mode but huge.
+func (opts *volumeOptions) writebackMarksIdle() bool {
+	return opts.writebackInterval > 0 && opts.writebackMode != writebackModeHuge
+}
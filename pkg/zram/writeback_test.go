@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritebackPages(t *testing.T) {
+	tests := []struct {
+		desc              string
+		opts              *volumeOptions
+		expectedIdle      string
+		expectedWriteback string
+	}{
+		{
+			desc:              "idle pages without age",
+			opts:              &volumeOptions{writebackInterval: time.Hour, writebackMode: writebackModeIdle},
+			expectedIdle:      "all",
+			expectedWriteback: "idle",
+		},
+		{
+			desc:              "idle pages with age",
+			opts:              &volumeOptions{writebackInterval: time.Hour, writebackIdleAge: 2 * time.Hour, writebackMode: writebackModeHugeIdle},
+			expectedIdle:      "7200",
+			expectedWriteback: "huge_idle",
+		},
+		{
+			desc:              "huge pages",
+			opts:              &volumeOptions{writebackInterval: time.Hour, writebackMode: writebackModeHuge},
+			expectedWriteback: "huge",
+		},
+	}
+
+	for _, test := range tests {
+		dev := newFakeZRAMDevice(t, map[string]string{"idle": "", "writeback": ""})
+		writebackPages(dev, test.opts)
+
+		idle, err := ioutil.ReadFile(filepath.Join(dev.sysPath, "idle"))
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedIdle, string(idle), test.desc)
+		writeback, err := ioutil.ReadFile(filepath.Join(dev.sysPath, "writeback"))
+		assert.NoError(t, err)
+		assert.Equal(t, test.expectedWriteback, string(writeback), test.desc)
+	}
+}
@@ -17,7 +17,9 @@ limitations under the License.
 package zram
 
 import (
+	"os"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
@@ -32,6 +34,12 @@ const (
 	TopologyKeyNode   = "topology.hostpath.csi/node"
 	mountOptionsField = "mountoptions"
 	capacityField     = "capacity"
+	// snapshotIDField is the snapshot a volume is restored from when it is staged
+	snapshotIDField = "snapshotid"
+	// sourceVolumeIDField is the volume a volume is cloned from when it is staged
+	sourceVolumeIDField = "sourcevolumeid"
+	// publishTargetsField lists the paths a volume is published on in ListVolumes and ControllerGetVolume
+	publishTargetsField = "publishtargets"
 )
 
 // DriverOptions defines driver parameters specified in driver deployment
@@ -41,6 +49,59 @@ type DriverOptions struct {
 	EnableGetVolumeStats bool
 	EnableTopology       bool
 	WorkingMountDir      string
+	// BackingDirRoot is the directory the backing files of volumes must be in, backing devices
+	// are disabled if empty
+	BackingDirRoot string
+	// DictionaryDir holds the compression dictionaries volumes can refer to
+	DictionaryDir string
+	// MetricsAddress is the address to serve Prometheus metrics on, disabled if empty
+	MetricsAddress string
+	// CompactInterval is how often staged devices are checked for compaction, disabled if zero
+	CompactInterval time.Duration
+	// CompactFragmentationThreshold is the ratio of mem_used_total to compr_data_size above
+	// which a device is compacted. Devices are compacted on every run if zero.
+	CompactFragmentationThreshold float64
+	// ReadOnlyWatchdogInterval is how often the memory usage of staged filesystems is checked
+	// against their memory limit, disabled if zero
+	ReadOnlyWatchdogInterval time.Duration
+	// ReadOnlyWatermark is the percentage of the memory limit above which a filesystem is
+	// remounted read-only
+	ReadOnlyWatermark float64
+	// ReadOnlyRecoverWatermark is the percentage of the memory limit below which a filesystem is
+	// remounted read-write. Filesystems stay read-only until unstaged if zero.
+	ReadOnlyRecoverWatermark float64
+	// CapacityCompressionRatio is the compression ratio expected when reporting capacity,
+	// 1 if not set
+	CapacityCompressionRatio float64
+	// CapacityOvercommit is the factor by which the reported capacity exceeds the free memory,
+	// 1 if not set
+	CapacityOvercommit float64
+	// MaxTotalZRAMBytes bounds the combined disksize of the volumes staged on the node, unlimited if zero
+	MaxTotalZRAMBytes int64
+	// MaxTotalZRAMPercent bounds the combined disksize to a percentage of MemTotal, unlimited if zero.
+	// The lower bound applies if both are set.
+	MaxTotalZRAMPercent float64
+	// KubeletDir is the kubelet root directory, used to find staged volumes after a restart
+	KubeletDir string
+	// StateDir holds the records of the volumes staged on the node, nothing is recorded if empty
+	StateDir string
+	// GenerationDir holds markers of the staged volumes that survive a reboot of the node, to
+	// detect the loss of their data. Nothing is recorded if empty.
+	GenerationDir string
+	// RecordDir holds what the node learned about its volumes, e.g. their expanded capacity, until
+	// they are deleted. Nothing is recorded if empty.
+	RecordDir string
+	// GCInterval is how often orphaned zram devices of the driver are looked for, disabled if zero
+	GCInterval time.Duration
+	// GCGracePeriod is how long a device must stay orphaned before it is removed
+	GCGracePeriod time.Duration
+	// GCDryRun only logs the orphaned devices that would be removed
+	GCDryRun bool
+	// SnapshotDir holds the archives of the snapshots taken on the node, snapshots are disabled if empty
+	SnapshotDir string
+	// ReconcileInterval is how often the mounts and devices of the staged volumes are checked
+	// and lost publish mounts restored, disabled if zero
+	ReconcileInterval time.Duration
 }
 
 // Driver implements all interfaces of CSI drivers
@@ -49,10 +110,48 @@ type Driver struct {
 	mounter *mount.SafeFormatAndMount
 	// A map storing all volumes with ongoing operations so that additional operations
 	// for that same volume (as defined by VolumeID) return an Aborted error
-	volumeLocks          *volumeLocks
+	volumeLocks *volumeLocks
+	// volumes staged on this node and their background tasks, such as writeback
+	volumes              *volumeRegistry
+	volumeTasks          *volumeTasks
 	workingMountDir      string
 	enableGetVolumeStats bool
 	enableTopology       bool
+	dictionaryDir        string
+	backingDirRoot       string
+	metricsAddress       string
+	// compaction of staged devices
+	compactInterval               time.Duration
+	compactFragmentationThreshold float64
+	// read-only protection of filesystems near their memory limit
+	readOnlyWatchdogInterval time.Duration
+	readOnlyWatermark        float64
+	readOnlyRecoverWatermark float64
+	// Kubernetes events on the volumes, only logged outside of a cluster
+	events eventRecorder
+	// capacity reporting
+	capacityCompressionRatio float64
+	capacityOvercommit       float64
+	// budget of the combined disksize of staged volumes
+	budget              *zramBudget
+	maxTotalZRAMBytes   int64
+	maxTotalZRAMPercent float64
+	kubeletDir          string
+	// records of the staged volumes and the devices found labelled by the driver,
+	// to recover from a restart
+	state     *stateStore
+	inventory *deviceInventory
+	// markers of the staged volumes kept across reboots
+	generations *generationStore
+	// records of the volumes kept until they are deleted
+	records *recordStore
+	// archives of the snapshots taken on this node
+	snapshots *snapshotStore
+	// removal of the devices left behind by interrupted operations
+	gcInterval time.Duration
+	gc         *deviceCollector
+	// checks of the mounts and devices of the staged volumes
+	reconcileInterval time.Duration
 }
 
 // NewDriver Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
@@ -65,7 +164,38 @@ func NewDriver(options *DriverOptions) *Driver {
 	driver.enableGetVolumeStats = options.EnableGetVolumeStats
 	driver.enableTopology = options.EnableTopology
 	driver.workingMountDir = options.WorkingMountDir
+	driver.dictionaryDir = options.DictionaryDir
+	driver.backingDirRoot = options.BackingDirRoot
+	driver.metricsAddress = options.MetricsAddress
+	driver.compactInterval = options.CompactInterval
+	driver.compactFragmentationThreshold = options.CompactFragmentationThreshold
+	driver.readOnlyWatchdogInterval = options.ReadOnlyWatchdogInterval
+	driver.readOnlyWatermark = options.ReadOnlyWatermark
+	driver.readOnlyRecoverWatermark = options.ReadOnlyRecoverWatermark
+	driver.events = logEventRecorder{}
+	driver.capacityCompressionRatio = options.CapacityCompressionRatio
+	if driver.capacityCompressionRatio <= 0 {
+		driver.capacityCompressionRatio = 1
+	}
+	driver.capacityOvercommit = options.CapacityOvercommit
+	if driver.capacityOvercommit <= 0 {
+		driver.capacityOvercommit = 1
+	}
+	driver.budget = newZRAMBudget()
+	driver.maxTotalZRAMBytes = options.MaxTotalZRAMBytes
+	driver.maxTotalZRAMPercent = options.MaxTotalZRAMPercent
+	driver.kubeletDir = options.KubeletDir
+	driver.state = newStateStore(options.StateDir)
+	driver.inventory = newDeviceInventory()
+	driver.generations = newGenerationStore(options.GenerationDir)
+	driver.records = newRecordStore(options.RecordDir)
+	driver.snapshots = newSnapshotStore(options.SnapshotDir)
+	driver.gcInterval = options.GCInterval
+	driver.gc = newDeviceCollector(options.GCGracePeriod, options.GCDryRun)
+	driver.reconcileInterval = options.ReconcileInterval
 	driver.volumeLocks = newVolumeLocks()
+	driver.volumes = newVolumeRegistry()
+	driver.volumeTasks = newVolumeTasks()
 	return &driver
 }
 
@@ -82,12 +212,84 @@ func (d *Driver) Run(endpoint string, testMode bool) {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
 
+	limit, err := d.budgetLimit()
+	if err != nil {
+		klog.Fatalf("Failed to get zram budget: %v", err)
+	}
+	d.budget.SetLimit(limit)
+
+	if d.state.dir != "" {
+		if err := os.MkdirAll(d.state.dir, 0750); err != nil {
+			klog.Fatalf("Failed to create state directory %s: %v", d.state.dir, err)
+		}
+	}
+	if d.generations.dir != "" {
+		if err := os.MkdirAll(d.generations.dir, 0750); err != nil {
+			klog.Fatalf("Failed to create generation directory %s: %v", d.generations.dir, err)
+		}
+	}
+	if d.records.dir != "" {
+		if err := os.MkdirAll(d.records.dir, 0750); err != nil {
+			klog.Fatalf("Failed to create record directory %s: %v", d.records.dir, err)
+		}
+	}
+	if d.snapshots.dir != "" {
+		if err := os.MkdirAll(d.snapshots.dir, 0750); err != nil {
+			klog.Fatalf("Failed to create snapshot directory %s: %v", d.snapshots.dir, err)
+		}
+		d.snapshots.RemoveIncomplete()
+		d.removeSnapshotCopies()
+	}
+	d.scanDevices()
+	d.recoverVolumes()
+	d.restoreBudget()
+	d.removeStaleBackingFiles()
+
+	if d.dictionaryDir != "" {
+		if err := os.MkdirAll(d.dictionaryDir, 0755); err != nil {
+			klog.Warningf("failed to create dictionary directory %s: %v", d.dictionaryDir, err)
+		}
+	}
+
+	if d.metricsAddress != "" {
+		d.serveMetrics(d.metricsAddress)
+	}
+
+	if d.compactInterval > 0 {
+		startPeriodicTask("compact", d.compactInterval, d.compactVolumes)
+	}
+
+	if d.readOnlyWatchdogInterval > 0 {
+		d.events = newEventRecorder(d.Name, d.NodeID)
+		startPeriodicTask("readonly-watchdog", d.readOnlyWatchdogInterval, d.watchMemoryUsage)
+	}
+
+	if d.gcInterval > 0 {
+		// the first pass runs on start, after the recovery of the staged volumes
+		startPeriodicTask("gc", d.gcInterval, d.collectOrphanedDevices)
+	}
+
+	if d.reconcileInterval > 0 {
+		startPeriodicTask("reconcile", d.reconcileInterval, d.reconcileVolumes)
+	}
+
 	// Initialize default library driver
-	d.AddControllerServiceCapabilities(
-		[]csi.ControllerServiceCapability_RPC_Type{
-			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-			csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-		})
+	controllerCap := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+	}
+	if d.snapshots.dir != "" {
+		controllerCap = append(controllerCap, csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS)
+	}
+	d.AddControllerServiceCapabilities(controllerCap)
 
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -96,9 +298,11 @@ func (d *Driver) Run(endpoint string, testMode bool) {
 	nodeCap := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 	}
 	if d.enableGetVolumeStats {
-		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS)
+		nodeCap = append(nodeCap, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+			csi.NodeServiceCapability_RPC_VOLUME_CONDITION)
 	}
 	d.AddNodeServiceCapabilities(nodeCap)
 
@@ -0,0 +1,196 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MMStat holds the memory statistics of a zram device, from mm_stat.
+// All sizes are in bytes. Columns missing on older kernels are left at zero.
+type MMStat struct {
+	// OrigDataSize is the uncompressed size of data stored in the device.
+	OrigDataSize int64
+	// ComprDataSize is the compressed size of data stored in the device.
+	ComprDataSize int64
+	// MemUsedTotal is the memory allocated for the device, including fragmentation and metadata.
+	MemUsedTotal int64
+	// MemLimit is the maximum memory the device may use, 0 if unlimited.
+	MemLimit int64
+	// MemUsedMax is the peak of MemUsedTotal.
+	MemUsedMax int64
+	// SamePages is the number of same element filled pages, which use no memory.
+	SamePages int64
+	// PagesCompacted is the number of pages freed during compaction.
+	PagesCompacted int64
+	// HugePages is the number of incompressible pages, since Linux 4.19.
+	HugePages int64
+	// HugePagesSince is the number of incompressible pages stored since the device was initialized, since Linux 5.15.
+	HugePagesSince int64
+}
+
+// IOStat holds the I/O error statistics of a zram device, from io_stat.
+type IOStat struct {
+	FailedReads  int64
+	FailedWrites int64
+	InvalidIO    int64
+	NotifyFree   int64
+}
+
+// BDStat holds the backing device statistics of a zram device, from bd_stat.
+// Counts are in units of 4K pages.
+type BDStat struct {
+	// BDCount is the amount of data currently stored in the backing device.
+	BDCount  int64
+	BDReads  int64
+	BDWrites int64
+}
+
+// DebugStat holds the content of debug_stat. Its format is not stable,
+// the values are kept in the order the kernel reports them.
+type DebugStat struct {
+	Version int
+	Values  []int64
+}
+
+// MMStat returns the memory statistics of the device.
+func (d *ZRAMDevice) MMStat() (*MMStat, error) {
+	data, err := d.readSysFile("mm_stat")
+	if err != nil {
+		return nil, err
+	}
+	return parseMMStat(data)
+}
+
+// IOStat returns the I/O error statistics of the device.
+func (d *ZRAMDevice) IOStat() (*IOStat, error) {
+	data, err := d.readSysFile("io_stat")
+	if err != nil {
+		return nil, err
+	}
+	return parseIOStat(data)
+}
+
+// BDStat returns the backing device statistics of the device,
+// the kernel only provides them when built with CONFIG_ZRAM_WRITEBACK.
+func (d *ZRAMDevice) BDStat() (*BDStat, error) {
+	data, err := d.readSysFile("bd_stat")
+	if err != nil {
+		return nil, err
+	}
+	return parseBDStat(data)
+}
+
+// DebugStat returns the debug statistics of the device.
+func (d *ZRAMDevice) DebugStat() (*DebugStat, error) {
+	data, err := d.readSysFile("debug_stat")
+	if err != nil {
+		return nil, err
+	}
+	return parseDebugStat(data)
+}
+
+func parseMMStat(data string) (*MMStat, error) {
+	stat := &MMStat{}
+	err := parseStatColumns("mm_stat", data, 7, []*int64{
+		&stat.OrigDataSize,
+		&stat.ComprDataSize,
+		&stat.MemUsedTotal,
+		&stat.MemLimit,
+		&stat.MemUsedMax,
+		&stat.SamePages,
+		&stat.PagesCompacted,
+		&stat.HugePages,
+		&stat.HugePagesSince,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+func parseIOStat(data string) (*IOStat, error) {
+	stat := &IOStat{}
+	err := parseStatColumns("io_stat", data, 3, []*int64{
+		&stat.FailedReads,
+		&stat.FailedWrites,
+		&stat.InvalidIO,
+		&stat.NotifyFree,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+func parseBDStat(data string) (*BDStat, error) {
+	stat := &BDStat{}
+	err := parseStatColumns("bd_stat", data, 3, []*int64{
+		&stat.BDCount,
+		&stat.BDReads,
+		&stat.BDWrites,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+// parseDebugStat parses debug_stat, e.g. "version: 1\n       0\n".
+func parseDebugStat(data string) (*DebugStat, error) {
+	stat := &DebugStat{}
+	fields := strings.Fields(data)
+	if len(fields) >= 2 && fields[0] == "version:" {
+		version, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q in debug_stat", fields[1])
+		}
+		stat.Version = version
+		fields = fields[2:]
+	}
+	for _, field := range fields {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q in debug_stat", field)
+		}
+		stat.Values = append(stat.Values, value)
+	}
+	return stat, nil
+}
+
+// parseStatColumns parses the whitespace separated columns of a stat file into values.
+// Kernels add columns over time, so extra columns are ignored and missing ones are left
+// untouched, as long as at least minColumns are present.
+func parseStatColumns(name, data string, minColumns int, values []*int64) error {
+	fields := strings.Fields(data)
+	if len(fields) < minColumns {
+		return fmt.Errorf("unexpected %s format, expected at least %d columns: %q", name, minColumns, data)
+	}
+	for i, field := range fields {
+		if i >= len(values) {
+			break
+		}
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid column %d in %s: %q", i+1, name, field)
+		}
+		*values[i] = value
+	}
+	return nil
+}
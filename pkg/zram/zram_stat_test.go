@@ -0,0 +1,146 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMMStat(t *testing.T) {
+	tests := []struct {
+		desc        string
+		data        string
+		expected    *MMStat
+		expectedErr bool
+	}{
+		{
+			desc: "linux 4.14",
+			data: "  4096  74  12288  0  12288  1  0\n",
+			expected: &MMStat{OrigDataSize: 4096, ComprDataSize: 74, MemUsedTotal: 12288,
+				MemUsedMax: 12288, SamePages: 1},
+		},
+		{
+			desc: "linux 5.4",
+			data: "  8192  4096  12288  10485760  16384  0  3  1\n",
+			expected: &MMStat{OrigDataSize: 8192, ComprDataSize: 4096, MemUsedTotal: 12288, MemLimit: 10485760,
+				MemUsedMax: 16384, PagesCompacted: 3, HugePages: 1},
+		},
+		{
+			desc: "linux 6.1",
+			data: "  8192  4096  12288  0  16384  2  0  1  5\n",
+			expected: &MMStat{OrigDataSize: 8192, ComprDataSize: 4096, MemUsedTotal: 12288,
+				MemUsedMax: 16384, SamePages: 2, HugePages: 1, HugePagesSince: 5},
+		},
+		{
+			desc: "future kernel with extra columns",
+			data: "1 2 3 4 5 6 7 8 9 10",
+			expected: &MMStat{OrigDataSize: 1, ComprDataSize: 2, MemUsedTotal: 3, MemLimit: 4, MemUsedMax: 5,
+				SamePages: 6, PagesCompacted: 7, HugePages: 8, HugePagesSince: 9},
+		},
+		{
+			desc:        "too few columns",
+			data:        "8192 4096 12288",
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid column",
+			data:        "8192 4096 12288 x 0 0 0",
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		stat, err := parseMMStat(test.data)
+		if test.expectedErr {
+			if err == nil {
+				t.Errorf("test[%s]: expected error, got %+v", test.desc, stat)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(stat, test.expected) {
+			t.Errorf("test[%s]: unexpected output: %+v, expected result: %+v", test.desc, stat, test.expected)
+		}
+	}
+}
+
+func TestParseIOStat(t *testing.T) {
+	stat, err := parseIOStat("       1        2        0       42\n")
+	assert.NoError(t, err)
+	assert.Equal(t, &IOStat{FailedReads: 1, FailedWrites: 2, NotifyFree: 42}, stat)
+
+	stat, err = parseIOStat("       1        2        3\n")
+	assert.NoError(t, err)
+	assert.Equal(t, &IOStat{FailedReads: 1, FailedWrites: 2, InvalidIO: 3}, stat)
+
+	_, err = parseIOStat("")
+	assert.Error(t, err)
+}
+
+func TestParseBDStat(t *testing.T) {
+	stat, err := parseBDStat("     100       20      300\n")
+	assert.NoError(t, err)
+	assert.Equal(t, &BDStat{BDCount: 100, BDReads: 20, BDWrites: 300}, stat)
+
+	_, err = parseBDStat("100 20")
+	assert.Error(t, err)
+}
+
+func TestParseDebugStat(t *testing.T) {
+	stat, err := parseDebugStat("version: 1\n       0\n")
+	assert.NoError(t, err)
+	assert.Equal(t, &DebugStat{Version: 1, Values: []int64{0}}, stat)
+
+	stat, err = parseDebugStat("version: 2\n       3        7\n")
+	assert.NoError(t, err)
+	assert.Equal(t, &DebugStat{Version: 2, Values: []int64{3, 7}}, stat)
+
+	_, err = parseDebugStat("version: x\n")
+	assert.Error(t, err)
+}
+
+func TestZRAMDeviceStats(t *testing.T) {
+	dev := newFakeZRAMDevice(t, map[string]string{
+		"mm_stat":    "8192 4096 12288 10485760 16384 0 0 1\n",
+		"io_stat":    "0 5 0 0\n",
+		"bd_stat":    "1 2 3\n",
+		"debug_stat": "version: 1\n 0\n",
+	})
+	mmStat, err := dev.MMStat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12288), mmStat.MemUsedTotal)
+	assert.Equal(t, int64(10485760), mmStat.MemLimit)
+	ioStat, err := dev.IOStat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), ioStat.FailedWrites)
+	bdStat, err := dev.BDStat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), bdStat.BDWrites)
+	debugStat, err := dev.DebugStat()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, debugStat.Version)
+
+	dev = newFakeZRAMDevice(t, nil)
+	_, err = dev.BDStat()
+	assert.Error(t, err)
+}
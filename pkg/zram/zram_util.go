@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/exec"
 	"k8s.io/utils/mount"
@@ -53,20 +54,43 @@ func NewZRAMDeviceFromMountPath(mountPath string) (*ZRAMDevice, error) {
 	if err != nil {
 		return nil, fmt.Errorf("faied to get device from mount path: %s", err.Error())
 	}
-	devName := filepath.Base(dev)
+	return NewZRAMDeviceFromDevPath(dev)
+}
+
+// NewZRAMDeviceFromDevPath returns the device of a path such as /dev/zram0.
+func NewZRAMDeviceFromDevPath(devPath string) (*ZRAMDevice, error) {
+	devName := filepath.Base(devPath)
 	if !strings.HasPrefix(devName, "zram") {
-		return nil, fmt.Errorf("invalid device: %s", dev)
+		return nil, fmt.Errorf("invalid device: %s", devPath)
 	}
 	id, err := strconv.Atoi(strings.TrimPrefix(devName, "zram"))
 	if err != nil {
 		return nil, fmt.Errorf("invalid device: %s", err.Error())
 	}
-	return &ZRAMDevice{
-		id:      id,
-		devPath: fmt.Sprintf("/dev/zram%d", id),
-		sysPath: fmt.Sprintf("/sys/block/zram%d", id),
-		mounter: &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()},
-	}, nil
+	return NewZRAMDeviceFromId(id)
+}
+
+// NewZRAMDeviceFromDeviceFile returns the device of a block special file, e.g. the
+// target a raw block volume is published on.
+func NewZRAMDeviceFromDeviceFile(path string) (*ZRAMDevice, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return nil, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return nil, fmt.Errorf("%s is not a block device", path)
+	}
+	link, err := os.Readlink(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device of %s: %v", path, err)
+	}
+	return NewZRAMDeviceFromDevPath(link)
+}
+
+// Exists returns true if the device has not been removed.
+func (d *ZRAMDevice) Exists() bool {
+	_, err := os.Stat(d.sysPath)
+	return err == nil
 }
 
 func (d *ZRAMDevice) GetId() int {
@@ -111,6 +135,15 @@ func (d *ZRAMDevice) writeSysFile(name, data string) error {
 	return fd.Close()
 }
 
+func (d *ZRAMDevice) readSysFile(name string) (string, error) {
+	fileName := filepath.Join(d.sysPath, name)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 func (d *ZRAMDevice) Reset() error {
 	return d.writeSysFile("reset", "1")
 }
@@ -123,14 +156,100 @@ func (d *ZRAMDevice) SetCompAlgorithm(compAlgorithm string) error {
 	return d.writeSysFile("comp_algorithm", compAlgorithm) // lzo-rle is default
 }
 
+// GetCompAlgorithms returns the compression algorithms supported by the device
+// together with the one currently selected.
+func (d *ZRAMDevice) GetCompAlgorithms() ([]string, string, error) {
+	data, err := d.readSysFile("comp_algorithm")
+	if err != nil {
+		return nil, "", err
+	}
+	algorithms, current := parseCompAlgorithms(data)
+	return algorithms, current, nil
+}
+
 func (d *ZRAMDevice) SetDiskSize(diskSize int64) error {
 	return d.writeSysFile("disksize", strconv.FormatInt(diskSize, 10))
 }
 
+// GetDiskSize returns the logical size of the device in bytes, 0 if it is not initialized.
+func (d *ZRAMDevice) GetDiskSize() (int64, error) {
+	data, err := d.readSysFile("disksize")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(data, 10, 64)
+}
+
 func (d *ZRAMDevice) SetMemLimit(memLimit int64) error {
 	return d.writeSysFile("mem_limit", strconv.FormatInt(memLimit, 10))
 }
 
+// SetBackingDev sets the block device used to write back idle or incompressible pages,
+// it must be set before disksize.
+func (d *ZRAMDevice) SetBackingDev(backingDev string) error {
+	return d.writeSysFile("backing_dev", backingDev)
+}
+
+// GetBackingDev returns the backing device path, or an empty string if there is none.
+func (d *ZRAMDevice) GetBackingDev() (string, error) {
+	data, err := d.readSysFile("backing_dev")
+	if err != nil {
+		return "", err
+	}
+	if data == "none" {
+		return "", nil
+	}
+	return data, nil
+}
+
+// Writeback writes pages of the given type ("idle", "huge" or "huge_idle") to the backing device.
+func (d *ZRAMDevice) Writeback(mode string) error {
+	return d.writeSysFile("writeback", mode)
+}
+
+// HasAttribute returns true if the kernel exposes the sysfs attribute for the device.
+func (d *ZRAMDevice) HasAttribute(name string) bool {
+	_, err := os.Stat(filepath.Join(d.sysPath, name))
+	return err == nil
+}
+
+// SetAlgorithmParams tunes the algorithm of the given priority, 0 being the primary algorithm.
+// A zero level keeps the default level, an empty dictionary path means no dictionary.
+// It must be set before disksize.
+func (d *ZRAMDevice) SetAlgorithmParams(priority, level int, dictionary string) error {
+	params := fmt.Sprintf("priority=%d", priority)
+	if level != 0 {
+		params += fmt.Sprintf(" level=%d", level)
+	}
+	if dictionary != "" {
+		params += " dict=" + dictionary
+	}
+	return d.writeSysFile("algorithm_params", params)
+}
+
+// SetRecompAlgorithm sets a secondary compression algorithm, priority 1 being the first
+// secondary algorithm. It must be set before disksize.
+func (d *ZRAMDevice) SetRecompAlgorithm(algorithm string, priority int) error {
+	return d.writeSysFile("recomp_algorithm", fmt.Sprintf("algo=%s priority=%d", algorithm, priority))
+}
+
+// Recompress recompresses pages with the secondary algorithms, params select the pages,
+// e.g. "type=idle threshold=3000".
+func (d *ZRAMDevice) Recompress(params string) error {
+	return d.writeSysFile("recompress", params)
+}
+
+// Compact triggers memory compaction of the device.
+func (d *ZRAMDevice) Compact() error {
+	return d.writeSysFile("compact", "1")
+}
+
+// MarkIdle marks pages as idle, either "all" pages or, on kernels tracking access time,
+// the pages that have not been accessed for the given number of seconds.
+func (d *ZRAMDevice) MarkIdle(mode string) error {
+	return d.writeSysFile("idle", mode)
+}
+
 func (d *ZRAMDevice) RefCount() (int, error) {
 	mps, err := d.mounter.List()
 	if err != nil {
@@ -169,7 +288,8 @@ func (d *ZRAMDevice) UnmountAndCleanup() error {
 	return err
 }
 
-func (d *ZRAMDevice) FormatAndMount(mountPath, fsType string, options []string) error {
+// FormatAndMount mounts the device, after creating a filesystem labelled label if it is not formatted.
+func (d *ZRAMDevice) FormatAndMount(mountPath, fsType, label string, options []string) error {
 	notMnt, err := d.mounter.IsLikelyNotMountPoint(mountPath)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("heuristic determination of mount point failed: %v", err)
@@ -184,6 +304,9 @@ func (d *ZRAMDevice) FormatAndMount(mountPath, fsType string, options []string)
 		return err
 	}
 
+	if err := d.Format(fsType, label); err != nil {
+		return err
+	}
 	err = d.mounter.FormatAndMount(d.devPath, mountPath, fsType, options)
 	if err != nil {
 		klog.Errorf("zram: failed to mount zram volume %s [%s] to %s, error %v", d.devPath, fsType, mountPath, err)
@@ -191,6 +314,106 @@ func (d *ZRAMDevice) FormatAndMount(mountPath, fsType string, options []string)
 	return err
 }
 
+// Format creates a filesystem labelled label on the device, unless it is already formatted.
+func (d *ZRAMDevice) Format(fsType, label string) error {
+	existingFormat, err := d.mounter.GetDiskFormat(d.devPath)
+	if err != nil {
+		return fmt.Errorf("failed to get disk format of %s: %v", d.devPath, err)
+	}
+	if existingFormat != "" {
+		return nil
+	}
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	args := mkfsArgs(fsType, label, d.devPath)
+	klog.Infof("zram: formatting %s as %s with options %v", d.devPath, fsType, args)
+	output, err := d.mounter.Exec.Command("mkfs."+fsType, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("format of %s as %s failed: %v, output: %s", d.devPath, fsType, err, string(output))
+	}
+	return nil
+}
+
+// mkfsArgs returns the arguments of mkfs for the filesystem type, the label is only set for
+// filesystems known to support one.
+func mkfsArgs(fsType, label, devPath string) []string {
+	var args []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		// force and zero blocks reserved for super-user, as the kubelet does
+		args = append(args, "-F", "-m0")
+		if label != "" {
+			args = append(args, "-L", label)
+		}
+	case "xfs", "btrfs":
+		if label != "" {
+			args = append(args, "-L", label)
+		}
+	}
+	return append(args, devPath)
+}
+
+// GetFilesystemLabel returns the label of the filesystem on the device, empty if there is none.
+func (d *ZRAMDevice) GetFilesystemLabel() (string, error) {
+	output, err := d.mounter.Exec.Command("blkid", "-p", "-s", "LABEL", "-o", "value", d.devPath).CombinedOutput()
+	if err != nil {
+		// blkid exits with 2 if the device has no filesystem or no label
+		if exit, ok := err.(exec.ExitError); ok && exit.ExitStatus() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("blkid %s failed: %v, output: %s", d.devPath, err, string(output))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// parseCompAlgorithms parses the content of comp_algorithm, e.g. "lzo [lzo-rle] lz4 zstd",
+// where the selected algorithm is enclosed in brackets.
+func parseCompAlgorithms(data string) ([]string, string) {
+	var algorithms []string
+	current := ""
+	for _, field := range strings.Fields(data) {
+		if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+			field = strings.TrimSuffix(strings.TrimPrefix(field, "["), "]")
+			current = field
+		}
+		algorithms = append(algorithms, field)
+	}
+	return algorithms, current
+}
+
+// GetNodeCompAlgorithms returns the compression algorithms supported by the zram
+// devices present on the node, or nil if there is no zram device to ask.
+func GetNodeCompAlgorithms() ([]string, error) {
+	files, err := filepath.Glob("/sys/block/zram*/comp_algorithm")
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		return nil, err
+	}
+	algorithms, _ := parseCompAlgorithms(string(data))
+	return algorithms, nil
+}
+
+// ListZRAMDevices returns all zram devices of the node, including the ones not managed by the driver.
+func ListZRAMDevices() ([]*ZRAMDevice, error) {
+	dirs, err := filepath.Glob("/sys/block/zram*")
+	if err != nil {
+		return nil, err
+	}
+	var devices []*ZRAMDevice
+	for _, dir := range dirs {
+		dev, err := NewZRAMDeviceFromDevPath(dir)
+		if err != nil {
+			continue
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
 // GetDeviceNameFromMount given a mnt point, find the device from /proc/mounts
 // returns the device name, reference count, and error code.
 func GetDeviceNameFromMountPath(mounter mount.Interface, mountPath string) (string, int, error) {
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package zram
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeZRAMDevice returns a device whose sysfs attributes live in a temporary directory.
+func newFakeZRAMDevice(t *testing.T, attrs map[string]string) *ZRAMDevice {
+	sysPath := t.TempDir()
+	for name, data := range attrs {
+		if err := ioutil.WriteFile(filepath.Join(sysPath, name), []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return &ZRAMDevice{
+		id:      0,
+		devPath: "/dev/zram0",
+		sysPath: sysPath,
+	}
+}
+
+func TestParseCompAlgorithms(t *testing.T) {
+	tests := []struct {
+		desc               string
+		data               string
+		expectedAlgorithms []string
+		expectedCurrent    string
+	}{
+		{
+			desc: "empty",
+			data: "",
+		},
+		{
+			desc:               "default algorithm",
+			data:               "lzo [lzo-rle] lz4 lz4hc 842 zstd\n",
+			expectedAlgorithms: []string{"lzo", "lzo-rle", "lz4", "lz4hc", "842", "zstd"},
+			expectedCurrent:    "lzo-rle",
+		},
+		{
+			desc:               "last algorithm selected",
+			data:               "lzo lz4 [zstd]",
+			expectedAlgorithms: []string{"lzo", "lz4", "zstd"},
+			expectedCurrent:    "zstd",
+		},
+	}
+
+	for _, test := range tests {
+		algorithms, current := parseCompAlgorithms(test.data)
+		if !reflect.DeepEqual(algorithms, test.expectedAlgorithms) || current != test.expectedCurrent {
+			t.Errorf("test[%s]: unexpected output: %v %q, expected result: %v %q",
+				test.desc, algorithms, current, test.expectedAlgorithms, test.expectedCurrent)
+		}
+	}
+}
+
+func TestGetCompAlgorithms(t *testing.T) {
+	dev := newFakeZRAMDevice(t, map[string]string{"comp_algorithm": "lzo [lzo-rle] zstd\n"})
+	algorithms, current, err := dev.GetCompAlgorithms()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lzo", "lzo-rle", "zstd"}, algorithms)
+	assert.Equal(t, "lzo-rle", current)
+
+	dev = newFakeZRAMDevice(t, nil)
+	_, _, err = dev.GetCompAlgorithms()
+	assert.Error(t, err)
+}
+
+func TestGetBackingDev(t *testing.T) {
+	dev := newFakeZRAMDevice(t, map[string]string{"backing_dev": "none\n"})
+	backingDev, err := dev.GetBackingDev()
+	assert.NoError(t, err)
+	assert.Equal(t, "", backingDev)
+
+	dev = newFakeZRAMDevice(t, map[string]string{"backing_dev": "/dev/loop3\n"})
+	backingDev, err = dev.GetBackingDev()
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/loop3", backingDev)
+}
+
+func TestSetAlgorithmParams(t *testing.T) {
+	dev := newFakeZRAMDevice(t, map[string]string{"algorithm_params": ""})
+	assert.True(t, dev.HasAttribute("algorithm_params"))
+	assert.False(t, dev.HasAttribute("recomp_algorithm"))
+
+	err := dev.SetAlgorithmParams(0, 9, "/var/lib/zram.csi.k8s.io/dictionaries/logs.dict")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dev.sysPath, "algorithm_params"))
+	assert.NoError(t, err)
+	assert.Equal(t, "priority=0 level=9 dict=/var/lib/zram.csi.k8s.io/dictionaries/logs.dict", string(data))
+
+	assert.NoError(t, os.Truncate(filepath.Join(dev.sysPath, "algorithm_params"), 0))
+	err = dev.SetAlgorithmParams(1, 3, "")
+	assert.NoError(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(dev.sysPath, "algorithm_params"))
+	assert.NoError(t, err)
+	assert.Equal(t, "priority=1 level=3", string(data))
+}